@@ -2,11 +2,11 @@ package treblle
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"golang.org/x/sync/semaphore"
 )
 
 // contextKey type for request context values
@@ -19,12 +19,73 @@ const (
 	treblleRequestInfoKey contextKey = "treblle_request_info"
 )
 
-// AsyncProcessor manages asynchronous processing with controlled concurrency
+const (
+	defaultAsyncQueueSize      = 1000
+	defaultAsyncQueueMaxBytes  = 32 << 20
+	defaultAsyncEnqueueTimeout = 100 * time.Millisecond
+
+	// payloadOverhead approximates the size of a payload besides its
+	// headers, bodies and query
+	payloadOverhead = 1024
+)
+
+// OverflowPolicy decides what happens to a payload arriving at a full queue
+type OverflowPolicy string
+
+const (
+	OverflowDropNewest OverflowPolicy = "drop_newest" // Drop the arriving payload
+	OverflowDropOldest OverflowPolicy = "drop_oldest" // Evict the oldest queued payloads to make room
+	OverflowBlock      OverflowPolicy = "block"       // Wait up to the enqueue timeout for room, then drop the arriving payload
+)
+
+// AsyncStats counts what happened to the payloads handed to an AsyncProcessor.
+// Payloads dropped from the queue are spooled when a spool is configured.
+type AsyncStats struct {
+	Queued          int    // Payloads waiting for a worker
+	QueuedBytes     int64  // Approximate size of the waiting payloads
+	Sent            uint64 // Payloads delivered, or handed to a batching Sender
+	Failed          uint64 // Payloads the Sender failed to deliver
+	Spooled         uint64 // Payloads the Sender failed to deliver, kept in the spool
+	DroppedNewest   uint64 // Arriving payloads dropped because the queue was full
+	DroppedOldest   uint64 // Queued payloads evicted for newer ones
+	DroppedTimeout  uint64 // Arriving payloads dropped after waiting for room
+	DroppedShutdown uint64 // Payloads arriving after, or still queued at the end of, Shutdown
+}
+
+// queuedPayload is a payload waiting for a worker
+type queuedPayload struct {
+	payload MetaData
+	size    int64
+}
+
+// AsyncProcessor delivers payloads from a bounded queue with a fixed pool
+// of workers, applying its overflow policy when the queue is full
 type AsyncProcessor struct {
-	sem    *semaphore.Weighted
-	wg     sync.WaitGroup
+	mu          sync.Mutex
+	ready       *sync.Cond // Signalled when a payload is queued or the processor closes
+	queue       []queuedPayload
+	queuedBytes int64
+	pending     int           // Payloads queued or being sent
+	idle        chan struct{} // Closed when nothing is pending
+	freed       chan struct{} // Closed, and replaced, when queue room frees up
+	closing     chan struct{} // Closed by Shutdown
+	closed      bool
+
+	maxQueue       int
+	maxBytes       int64
+	policy         OverflowPolicy
+	enqueueTimeout time.Duration
+
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	sent            atomic.Uint64
+	failed          atomic.Uint64
+	spooled         atomic.Uint64
+	droppedNewest   atomic.Uint64
+	droppedOldest   atomic.Uint64
+	droppedTimeout  atomic.Uint64
+	droppedShutdown atomic.Uint64
 }
 
 // RequestTracker stores and retrieves request data using context
@@ -32,22 +93,55 @@ type RequestTracker struct{}
 
 var (
 	// Global async processor instance
-	asyncProcessor     *AsyncProcessor
-	asyncProcessorOnce sync.Once
+	asyncProcessor        *AsyncProcessor
+	asyncProcessorOnce    sync.Once
+	asyncProcessorStarted atomic.Bool // Set once asyncProcessor is created
 
 	// Global request tracker instance
 	requestTracker     *RequestTracker
 	requestTrackerOnce sync.Once
 )
 
-// NewAsyncProcessor creates a new async processor with controlled concurrency
+// NewAsyncProcessor creates a new async processor with maxConcurrent
+// workers, and the queue size, memory budget, overflow policy and enqueue
+// timeout of the configuration
 func NewAsyncProcessor(maxConcurrent int64) *AsyncProcessor {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 10
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	return &AsyncProcessor{
-		sem:    semaphore.NewWeighted(maxConcurrent),
-		ctx:    ctx,
-		cancel: cancel,
+	idle := make(chan struct{})
+	close(idle)
+	ap := &AsyncProcessor{
+		idle:           idle,
+		freed:          make(chan struct{}),
+		closing:        make(chan struct{}),
+		maxQueue:       Config.AsyncQueueSize,
+		maxBytes:       Config.AsyncQueueMaxBytes,
+		policy:         Config.AsyncOverflowPolicy,
+		enqueueTimeout: Config.AsyncEnqueueTimeout,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	ap.ready = sync.NewCond(&ap.mu)
+	if ap.maxQueue <= 0 {
+		ap.maxQueue = defaultAsyncQueueSize
+	}
+	if ap.maxBytes <= 0 {
+		ap.maxBytes = defaultAsyncQueueMaxBytes
+	}
+	if ap.policy == "" {
+		ap.policy = OverflowDropNewest
+	}
+	if ap.enqueueTimeout <= 0 {
+		ap.enqueueTimeout = defaultAsyncEnqueueTimeout
+	}
+
+	for i := int64(0); i < maxConcurrent; i++ {
+		go ap.work()
 	}
+	return ap
 }
 
 // GetAsyncProcessor returns the singleton async processor
@@ -58,6 +152,7 @@ func GetAsyncProcessor() *AsyncProcessor {
 			maxConcurrent = Config.MaxConcurrentProcessing
 		}
 		asyncProcessor = NewAsyncProcessor(int64(maxConcurrent))
+		asyncProcessorStarted.Store(true)
 	})
 	return asyncProcessor
 }
@@ -70,73 +165,238 @@ func GetRequestTracker() *RequestTracker {
 	return requestTracker
 }
 
-// Process handles the asynchronous processing of Treblle data
+// Process queues the payload of a request for delivery. It only blocks
+// with the OverflowBlock policy, for at most the enqueue timeout.
 func (ap *AsyncProcessor) Process(requestInfo RequestInfo, responseInfo ResponseInfo, errorProvider *ErrorProvider) {
-	ap.wg.Add(1)
+	// Create metadata
+	ti := MetaData{
+		ApiKey:    Config.APIKey,
+		ProjectID: Config.ProjectID,
+		Version:   Config.SDKVersion,
+		Sdk:       Config.SDKName,
+		//	Url:       requestInfo.RoutePath, // Use the normalized URL from requestInfo (critical for endpoint grouping)
+		Data: DataInfo{
+			Server:   Config.serverInfo,
+			Language: Config.languageInfo,
+			Request:  requestInfo,
+			Response: responseInfo,
+		},
+	}
+	item := queuedPayload{payload: ti, size: estimatePayloadSize(ti)}
+
+	// Payloads dropped from the queue are spooled when a spool is
+	// configured, once the lock is released
+	var dropped []MetaData
+	defer func() { spoolPayloads(dropped...) }()
 
-	// Process asynchronously
-	go func() {
-		defer ap.wg.Done()
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
 
-		// Create a context with timeout for acquiring the semaphore
-		acquireCtx, cancel := context.WithTimeout(ap.ctx, 100*time.Millisecond)
-		defer cancel()
+	if ap.closed {
+		ap.droppedShutdown.Add(1)
+		dropped = append(dropped, ti)
+		return
+	}
+	// A payload larger than the whole budget never fits
+	if item.size > ap.maxBytes {
+		ap.droppedNewest.Add(1)
+		dropped = append(dropped, ti)
+		return
+	}
 
-		// Try to acquire the semaphore
-		if err := ap.sem.Acquire(acquireCtx, 1); err != nil {
-			// If we can't acquire the semaphore in time, just drop the request
-			// This prevents backpressure during high load
+	var deadline <-chan time.Time
+	for !ap.fits(item.size) {
+		switch ap.policy {
+		case OverflowDropOldest:
+			evicted := ap.queue[0]
+			ap.queue[0] = queuedPayload{}
+			ap.queue = ap.queue[1:]
+			ap.queuedBytes -= evicted.size
+			ap.done()
+			ap.droppedOldest.Add(1)
+			dropped = append(dropped, evicted.payload)
+			continue
+		case OverflowBlock:
+			if deadline == nil {
+				timer := time.NewTimer(ap.enqueueTimeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+			freed := ap.freed
+			ap.mu.Unlock()
+			select {
+			case <-freed:
+				ap.mu.Lock()
+				if !ap.closed {
+					continue
+				}
+				ap.droppedShutdown.Add(1)
+			case <-deadline:
+				ap.mu.Lock()
+				ap.droppedTimeout.Add(1)
+			case <-ap.closing:
+				ap.mu.Lock()
+				ap.droppedShutdown.Add(1)
+			}
+			dropped = append(dropped, ti)
 			return
+		default:
+			ap.droppedNewest.Add(1)
+			dropped = append(dropped, ti)
+			return
+		}
+	}
+
+	ap.queue = append(ap.queue, item)
+	ap.queuedBytes += item.size
+	if ap.pending == 0 {
+		ap.idle = make(chan struct{})
+	}
+	ap.pending++
+	ap.ready.Signal()
+}
+
+// fits reports whether a payload of size can be queued. Callers hold mu.
+func (ap *AsyncProcessor) fits(size int64) bool {
+	return len(ap.queue) < ap.maxQueue && ap.queuedBytes+size <= ap.maxBytes
+}
+
+// done marks a pending payload as handled. Callers hold mu.
+func (ap *AsyncProcessor) done() {
+	ap.pending--
+	if ap.pending == 0 {
+		close(ap.idle)
+	}
+}
+
+// work delivers queued payloads until the processor is shut down and its
+// queue is empty
+func (ap *AsyncProcessor) work() {
+	for {
+		ap.mu.Lock()
+		for len(ap.queue) == 0 && !ap.closed {
+			ap.ready.Wait()
 		}
-		defer ap.sem.Release(1)
-
-		// Create metadata
-		ti := MetaData{
-			ApiKey:    Config.APIKey,
-			ProjectID: Config.ProjectID,
-			Version:   Config.SDKVersion,
-			Sdk:       Config.SDKName,
-			//	Url:       requestInfo.RoutePath, // Use the normalized URL from requestInfo (critical for endpoint grouping)
-			Data: DataInfo{
-				Server:   Config.serverInfo,
-				Language: Config.languageInfo,
-				Request:  requestInfo,
-				Response: responseInfo,
-			},
+		if len(ap.queue) == 0 {
+			ap.mu.Unlock()
+			return
 		}
+		item := ap.queue[0]
+		ap.queue[0] = queuedPayload{}
+		ap.queue = ap.queue[1:]
+		ap.queuedBytes -= item.size
+		close(ap.freed)
+		ap.freed = make(chan struct{})
+		ap.mu.Unlock()
 
-		// Use a context with timeout for the API call
-		sendCtx, sendCancel := context.WithTimeout(ap.ctx, 2*time.Second)
-		defer sendCancel()
+		ap.send(item.payload)
+
+		ap.mu.Lock()
+		ap.done()
+		ap.mu.Unlock()
+	}
+}
 
-		// Send to Treblle with context
-		sendToTreblleWithContext(sendCtx, ti)
+// send delivers one payload within the send timeout
+func (ap *AsyncProcessor) send(ti MetaData) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("Panic recovered in goroutine: %v\n", err)
+			ap.failed.Add(1)
+		}
 	}()
+
+	// Use a context with timeout for the API call, retries included
+	sendCtx, sendCancel := context.WithTimeout(ap.ctx, sendTimeout())
+	defer sendCancel()
+
+	// Send to Treblle with context
+	spooled, err := deliverPayload(sendCtx, ti)
+	switch {
+	case err != nil:
+		ap.failed.Add(1)
+	case spooled:
+		ap.spooled.Add(1)
+	default:
+		ap.sent.Add(1)
+	}
+}
+
+// Stats returns the queue state and the payload counters
+func (ap *AsyncProcessor) Stats() AsyncStats {
+	ap.mu.Lock()
+	queued, queuedBytes := len(ap.queue), ap.queuedBytes
+	ap.mu.Unlock()
+
+	return AsyncStats{
+		Queued:          queued,
+		QueuedBytes:     queuedBytes,
+		Sent:            ap.sent.Load(),
+		Failed:          ap.failed.Load(),
+		Spooled:         ap.spooled.Load(),
+		DroppedNewest:   ap.droppedNewest.Load(),
+		DroppedOldest:   ap.droppedOldest.Load(),
+		DroppedTimeout:  ap.droppedTimeout.Load(),
+		DroppedShutdown: ap.droppedShutdown.Load(),
+	}
 }
 
 // Wait waits for all processing to complete with a timeout
 func (ap *AsyncProcessor) Wait(timeout time.Duration) bool {
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		ap.wg.Wait()
-	}()
+	ap.mu.Lock()
+	idle := ap.idle
+	ap.mu.Unlock()
 
 	select {
-	case <-c:
+	case <-idle:
 		return true // All processing completed
 	case <-time.After(timeout):
 		return false // Timed out
 	}
 }
 
-// Shutdown gracefully shuts down the processor
+// Shutdown stops accepting payloads and delivers the queued ones until
+// timeout, then cancels the sends in progress and drops what is left, or
+// spools it when a spool is configured
 func (ap *AsyncProcessor) Shutdown(timeout time.Duration) {
-	// Signal cancellation to all operations
-	ap.cancel()
+	ap.mu.Lock()
+	if !ap.closed {
+		ap.closed = true
+		close(ap.closing)
+		ap.ready.Broadcast()
+	}
+	ap.mu.Unlock()
 
-	// Wait for ongoing operations to complete
+	// Wait for queued and ongoing operations to complete
 	ap.Wait(timeout)
+
+	// Signal cancellation to the sends still running
+	ap.cancel()
+
+	ap.mu.Lock()
+	left := make([]MetaData, 0, len(ap.queue))
+	for _, item := range ap.queue {
+		ap.droppedShutdown.Add(1)
+		ap.done()
+		left = append(left, item.payload)
+	}
+	ap.queue = nil
+	ap.queuedBytes = 0
+	ap.mu.Unlock()
+
+	// Keep what was left for the next process when a spool is configured
+	spoolPayloads(left...)
+}
+
+// estimatePayloadSize approximates the marshalled size of a payload from
+// its headers, bodies and query without marshalling it
+func estimatePayloadSize(ti MetaData) int64 {
+	request, response := ti.Data.Request, ti.Data.Response
+	size := payloadOverhead +
+		len(request.Url) + len(request.RoutePath) + len(request.UserAgent) +
+		len(request.Headers) + len(request.Body) + len(request.Query) +
+		len(response.Headers) + len(response.Body)
+	return int64(size)
 }
 
 // StoreStartTime stores the request start time in context
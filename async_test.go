@@ -1,10 +1,17 @@
 package treblle
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAsyncProcessor_Process(t *testing.T) {
@@ -136,3 +143,151 @@ func TestAsyncShutdown(t *testing.T) {
 		t.Errorf("Shutdown took %v, expected to be quick", duration)
 	}
 }
+
+// blockingSender records payloads, holding each send until released
+type blockingSender struct {
+	MemorySender
+	release chan struct{}
+}
+
+func newBlockingSender() *blockingSender {
+	return &blockingSender{release: make(chan struct{})}
+}
+
+func (s *blockingSender) Send(ctx context.Context, payload MetaData) error {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.MemorySender.Send(ctx, payload)
+}
+
+// startBusyProcessor returns a processor with one worker busy sending a
+// first payload
+func startBusyProcessor(t *testing.T, config Configuration) (*AsyncProcessor, *blockingSender) {
+	sender := newBlockingSender()
+	config.Sender = sender
+	Configure(config)
+	t.Cleanup(func() { Configure(Configuration{}) })
+
+	processor := NewAsyncProcessor(1)
+	t.Cleanup(func() { processor.Shutdown(0) })
+	processor.Process(RequestInfo{Url: "/busy"}, ResponseInfo{}, nil)
+	require.Eventually(t, func() bool { return processor.Stats().Queued == 0 }, time.Second, time.Millisecond)
+	return processor, sender
+}
+
+func deliveredUrls(sender *blockingSender) []string {
+	var urls []string
+	for _, payload := range sender.Payloads() {
+		urls = append(urls, payload.Data.Request.Url)
+	}
+	return urls
+}
+
+func TestAsyncProcessorDropNewest(t *testing.T) {
+	processor, sender := startBusyProcessor(t, Configuration{AsyncQueueSize: 2})
+
+	for _, url := range []string{"/1", "/2", "/3"} {
+		processor.Process(RequestInfo{Url: url}, ResponseInfo{}, nil)
+	}
+	stats := processor.Stats()
+	assert.Equal(t, 2, stats.Queued)
+	assert.Equal(t, uint64(1), stats.DroppedNewest)
+
+	close(sender.release)
+	require.True(t, processor.Wait(time.Second))
+	assert.Equal(t, []string{"/busy", "/1", "/2"}, deliveredUrls(sender))
+	assert.Equal(t, uint64(3), processor.Stats().Sent)
+}
+
+func TestAsyncProcessorDropOldest(t *testing.T) {
+	processor, sender := startBusyProcessor(t, Configuration{AsyncQueueSize: 2, AsyncOverflowPolicy: OverflowDropOldest})
+
+	for _, url := range []string{"/1", "/2", "/3"} {
+		processor.Process(RequestInfo{Url: url}, ResponseInfo{}, nil)
+	}
+	assert.Equal(t, uint64(1), processor.Stats().DroppedOldest)
+
+	close(sender.release)
+	require.True(t, processor.Wait(time.Second))
+	assert.Equal(t, []string{"/busy", "/2", "/3"}, deliveredUrls(sender))
+}
+
+func TestAsyncProcessorBlock(t *testing.T) {
+	processor, sender := startBusyProcessor(t, Configuration{
+		AsyncQueueSize:      1,
+		AsyncOverflowPolicy: OverflowBlock,
+		AsyncEnqueueTimeout: 50 * time.Millisecond,
+	})
+
+	processor.Process(RequestInfo{Url: "/1"}, ResponseInfo{}, nil)
+
+	// Times out while the worker stays busy
+	start := time.Now()
+	processor.Process(RequestInfo{Url: "/2"}, ResponseInfo{}, nil)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, uint64(1), processor.Stats().DroppedTimeout)
+
+	// Gets in once the worker frees room
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sender.release <- struct{}{}
+	}()
+	processor.Process(RequestInfo{Url: "/3"}, ResponseInfo{}, nil)
+	assert.Equal(t, uint64(1), processor.Stats().DroppedTimeout)
+
+	close(sender.release)
+	require.True(t, processor.Wait(time.Second))
+	assert.Equal(t, []string{"/busy", "/1", "/3"}, deliveredUrls(sender))
+}
+
+func TestAsyncProcessorMemoryBudget(t *testing.T) {
+	body := json.RawMessage(`"` + strings.Repeat("x", 2000) + `"`)
+	processor, sender := startBusyProcessor(t, Configuration{AsyncQueueMaxBytes: 4000})
+
+	processor.Process(RequestInfo{Url: "/1", Body: body}, ResponseInfo{}, nil)
+	processor.Process(RequestInfo{Url: "/2", Body: body}, ResponseInfo{}, nil)
+	processor.Process(RequestInfo{Url: "/huge", Body: json.RawMessage(strings.Repeat("1", 5000))}, ResponseInfo{}, nil)
+
+	stats := processor.Stats()
+	assert.Equal(t, 1, stats.Queued)
+	assert.Greater(t, stats.QueuedBytes, int64(2000))
+	assert.Equal(t, uint64(2), stats.DroppedNewest)
+
+	close(sender.release)
+	require.True(t, processor.Wait(time.Second))
+	assert.Zero(t, processor.Stats().QueuedBytes)
+}
+
+func TestAsyncProcessorShutdownDropsWhatIsLeft(t *testing.T) {
+	processor, sender := startBusyProcessor(t, Configuration{})
+
+	processor.Process(RequestInfo{Url: "/1"}, ResponseInfo{}, nil)
+	processor.Shutdown(20 * time.Millisecond)
+	processor.Process(RequestInfo{Url: "/late"}, ResponseInfo{}, nil)
+
+	require.True(t, processor.Wait(time.Second))
+	stats := processor.Stats()
+	assert.Equal(t, uint64(2), stats.DroppedShutdown)
+	assert.Equal(t, uint64(1), stats.Failed, "the send in progress is cancelled")
+	assert.Empty(t, sender.Payloads())
+}
+
+func TestAsyncProcessorCountsFailures(t *testing.T) {
+	Configure(Configuration{Sender: SenderFunc(func(ctx context.Context, payload MetaData) error {
+		if payload.Data.Request.Url == "/panic" {
+			panic("sender panicked")
+		}
+		return errors.New("unreachable")
+	})})
+	defer Configure(Configuration{})
+
+	processor := NewAsyncProcessor(2)
+	processor.Process(RequestInfo{Url: "/fail"}, ResponseInfo{}, nil)
+	processor.Process(RequestInfo{Url: "/panic"}, ResponseInfo{}, nil)
+	require.True(t, processor.Wait(time.Second))
+	assert.Equal(t, uint64(2), processor.Stats().Failed)
+	processor.Shutdown(time.Second)
+}
@@ -0,0 +1,247 @@
+package treblle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPayloadBatchSize     = 100
+	defaultPayloadBatchMaxBytes = 1 << 20
+	defaultPayloadBatchLinger   = time.Second
+)
+
+// ErrNoBatchEndpoint is returned for batches of a BatchSender without an
+// Endpoint. The Treblle payload endpoints take a single payload per request.
+var ErrNoBatchEndpoint = errors.New("treblle batch sender has no endpoint")
+
+// BatchFormat is how a batch of payloads is encoded
+type BatchFormat string
+
+const (
+	BatchJSONArray BatchFormat = "json"   // A JSON array of payloads, sent as application/json
+	BatchNDJSON    BatchFormat = "ndjson" // One payload per line, sent as application/x-ndjson
+)
+
+// Flusher is implemented by Senders holding payloads back. Shutdown and
+// GracefulShutdown flush the configured Sender.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// BatchSender groups payloads into batches posted over HTTP in a single
+// request. A batch is sent once it holds MaxPayloads payloads, would grow
+// past MaxBytes, or its first payload has waited for Linger.
+type BatchSender struct {
+	Endpoint    string        // URL batches are posted to, required
+	Format      BatchFormat   // How batches are encoded (default: BatchJSONArray)
+	MaxPayloads int           // Payloads per batch (default: 100)
+	MaxBytes    int           // Largest batch before compression, a larger payload is sent alone (default: 1MB)
+	Linger      time.Duration // Longest a payload waits for its batch to fill (default: 1s)
+	HTTP        *HTTPSender   // Sender delivering the batches, with its retries and compression (default: a new HTTPSender)
+
+	mu    sync.Mutex
+	batch []json.RawMessage
+	size  int
+	timer *time.Timer
+}
+
+// newBatchSender returns the BatchSender of the configuration
+func newBatchSender(config Configuration) *BatchSender {
+	return &BatchSender{
+		Endpoint:    config.PayloadBatchEndpoint,
+		Format:      config.PayloadBatchFormat,
+		MaxPayloads: config.PayloadBatchSize,
+		MaxBytes:    config.PayloadBatchMaxBytes,
+		Linger:      config.PayloadBatchLinger,
+		HTTP:        &HTTPSender{},
+	}
+}
+
+// Send adds payload to the current batch, sending the batches it fills.
+// Errors of batches sent once Linger passes are only reported in debug mode.
+func (s *BatchSender) Send(ctx context.Context, payload MetaData) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	maxPayloads, maxBytes := s.MaxPayloads, s.MaxBytes
+	if maxPayloads <= 0 {
+		maxPayloads = defaultPayloadBatchSize
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultPayloadBatchMaxBytes
+	}
+
+	var full [][]json.RawMessage
+	s.mu.Lock()
+	if len(s.batch) > 0 && s.size+len(data) > maxBytes {
+		full = append(full, s.take())
+	}
+	s.batch = append(s.batch, data)
+	s.size += len(data)
+	if len(s.batch) >= maxPayloads || s.size >= maxBytes {
+		full = append(full, s.take())
+	} else if len(s.batch) == 1 {
+		linger := s.Linger
+		if linger <= 0 {
+			linger = defaultPayloadBatchLinger
+		}
+		s.timer = time.AfterFunc(linger, s.flushLingering)
+	}
+	s.mu.Unlock()
+
+	for _, batch := range full {
+		if batchErr := s.deliver(ctx, batch); batchErr != nil {
+			err = batchErr
+		}
+	}
+	return err
+}
+
+// Flush sends the current batch
+func (s *BatchSender) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	batch := s.take()
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return s.deliver(ctx, batch)
+}
+
+// flushLingering sends a batch whose first payload waited for Linger
+func (s *BatchSender) flushLingering() {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout())
+	defer cancel()
+
+	if err := s.Flush(ctx); err != nil && Config.Debug {
+		fmt.Printf("Failed to send payload batch: %v\n", err)
+	}
+}
+
+// take empties the current batch and returns it. Callers hold mu.
+func (s *BatchSender) take() []json.RawMessage {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	batch := s.batch
+	s.batch = nil
+	s.size = 0
+	return batch
+}
+
+// deliver posts batch unless the circuit is open, spooling it when that
+// fails and a spool is configured
+func (s *BatchSender) deliver(ctx context.Context, batch []json.RawMessage) error {
+	// The batch is spooled with its key, so replaying it is not counted twice
+	key := newIdempotencyKey()
+	start := time.Now()
+	err := Config.breaker.guard(func() error { return s.post(withIdempotencyKey(ctx, key), batch) })
+	telemetry.recordDelivery(len(batch), start, err)
+	if err == nil {
+		Config.spool.delivered()
+		return nil
+	}
+	if spoolFailed(err, key, batch...) {
+		return nil
+	}
+	return err
+}
+
+// replay posts spooled payloads in batches, returning how many got through
+// before the first failure. Payloads spooled together under a key are posted
+// again as that batch, under that key. The others are batched under a new
+// key, stored in records so a further replay posts the same batch.
+func (s *BatchSender) replay(records []spooledPayload) (int, error) {
+	maxPayloads, maxBytes := s.MaxPayloads, s.MaxBytes
+	if maxPayloads <= 0 {
+		maxPayloads = defaultPayloadBatchSize
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultPayloadBatchMaxBytes
+	}
+
+	sent := 0
+	for sent < len(records) {
+		end := sent + 1
+		key := records[sent].key
+		if key != "" {
+			for end < len(records) && records[end].key == key {
+				end++
+			}
+		} else {
+			key = newIdempotencyKey()
+			size := len(records[sent].payload)
+			for end < len(records) && records[end].key == "" && end-sent < maxPayloads && size+len(records[end].payload) <= maxBytes {
+				size += len(records[end].payload)
+				end++
+			}
+			for i := sent; i < end; i++ {
+				records[i].key = key
+			}
+		}
+
+		batch := make([]json.RawMessage, 0, end-sent)
+		for _, record := range records[sent:end] {
+			batch = append(batch, record.payload)
+		}
+		ctx, cancel := context.WithTimeout(withIdempotencyKey(context.Background(), key), sendTimeout())
+		err := s.post(ctx, batch)
+		cancel()
+		if err != nil && isSpoolable(err) {
+			return sent, err
+		}
+		sent = end
+	}
+	return sent, nil
+}
+
+// post encodes batch and posts it
+func (s *BatchSender) post(ctx context.Context, batch []json.RawMessage) error {
+	// Refused outright, retrying or spooling the batch would not help
+	if s.Endpoint == "" {
+		return &sendError{err: ErrNoBatchEndpoint}
+	}
+
+	body, contentType := encodeBatch(batch, s.Format)
+	sender := s.HTTP
+	if sender == nil {
+		sender = &HTTPSender{}
+	}
+
+	if Config.Debug {
+		fmt.Printf("Sending a batch of %d payloads (%d bytes) to %s\n", len(batch), len(body), s.Endpoint)
+	}
+	return sender.deliver(ctx, []string{s.Endpoint}, body, contentType)
+}
+
+// encodeBatch encodes marshalled payloads in format
+func encodeBatch(batch []json.RawMessage, format BatchFormat) ([]byte, string) {
+	var buf bytes.Buffer
+	if format == BatchNDJSON {
+		for _, payload := range batch {
+			buf.Write(payload)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), "application/x-ndjson"
+	}
+
+	buf.WriteByte('[')
+	for i, payload := range batch {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(payload)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), "application/json"
+}
@@ -0,0 +1,171 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchReceiver records the batches posted to it as lists of project IDs
+type batchReceiver struct {
+	mu           sync.Mutex
+	contentTypes []string
+	batches      [][]string
+}
+
+func (b *batchReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	var payloads []MetaData
+	if r.Header.Get("Content-Type") == "application/x-ndjson" {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(nil, len(body)+1)
+		for scanner.Scan() {
+			var payload MetaData
+			if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			payloads = append(payloads, payload)
+		}
+	} else if err := json.Unmarshal(body, &payloads); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	projects := make([]string, len(payloads))
+	for i, payload := range payloads {
+		projects[i] = payload.ProjectID
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.contentTypes = append(b.contentTypes, r.Header.Get("Content-Type"))
+	b.batches = append(b.batches, projects)
+}
+
+func (b *batchReceiver) received() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.batches...)
+}
+
+func newBatchServer(t *testing.T) (*batchReceiver, string) {
+	receiver := &batchReceiver{}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server.URL
+}
+
+func TestBatchSenderFlushesFullBatches(t *testing.T) {
+	Configure(Configuration{})
+	receiver, url := newBatchServer(t)
+
+	sender := &BatchSender{Endpoint: url, MaxPayloads: 3, Linger: time.Hour}
+	for _, project := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: project}))
+	}
+	assert.Equal(t, [][]string{{"a", "b", "c"}}, receiver.received())
+	assert.Equal(t, []string{"application/json"}, receiver.contentTypes)
+
+	require.NoError(t, sender.Flush(context.Background()))
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"d"}}, receiver.received())
+
+	// Nothing left to flush
+	require.NoError(t, sender.Flush(context.Background()))
+	assert.Len(t, receiver.received(), 2)
+}
+
+func TestBatchSenderMaxBytes(t *testing.T) {
+	Configure(Configuration{})
+	receiver, url := newBatchServer(t)
+
+	payload := MetaData{ProjectID: strings.Repeat("p", 200)}
+	data, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	// Room for two payloads, the third starts a new batch
+	sender := &BatchSender{Endpoint: url, MaxBytes: 2*len(data) + 10, Linger: time.Hour}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sender.Send(context.Background(), payload))
+	}
+	require.Len(t, receiver.received(), 1)
+	assert.Len(t, receiver.received()[0], 2)
+}
+
+func TestBatchSenderLinger(t *testing.T) {
+	Configure(Configuration{})
+	receiver, url := newBatchServer(t)
+
+	sender := &BatchSender{Endpoint: url, Format: BatchNDJSON, Linger: 20 * time.Millisecond}
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "a"}))
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "b"}))
+	assert.Empty(t, receiver.received())
+
+	require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, [][]string{{"a", "b"}}, receiver.received())
+	assert.Equal(t, []string{"application/x-ndjson"}, receiver.contentTypes)
+}
+
+func TestConfiguredPayloadBatchingFlushedOnShutdown(t *testing.T) {
+	receiver, url := newBatchServer(t)
+	Configure(Configuration{
+		API_KEY:                "project",
+		PayloadBatchingEnabled: true,
+		PayloadBatchEndpoint:   url,
+		PayloadBatchLinger:     time.Hour,
+	})
+	defer Configure(Configuration{})
+	require.IsType(t, &BatchSender{}, Config.Sender)
+
+	sendToTreblle(MetaData{ProjectID: "one"})
+	sendToTreblle(MetaData{ProjectID: "two"})
+	assert.Empty(t, receiver.received())
+
+	GracefulShutdown()
+	assert.Equal(t, [][]string{{"one", "two"}}, receiver.received())
+
+	ShutdownWithCustomData(RequestInfo{}, ResponseInfo{}, nil)
+	assert.Equal(t, [][]string{{"one", "two"}, {"project"}}, receiver.received())
+}
+
+func TestPayloadBatchingIgnoredWithCustomSender(t *testing.T) {
+	sender := &MemorySender{}
+	Configure(Configuration{Sender: sender, PayloadBatchingEnabled: true})
+	defer Configure(Configuration{})
+	assert.Same(t, sender, Config.Sender)
+}
+
+func TestPayloadBatchingRequiresAnEndpoint(t *testing.T) {
+	Configure(Configuration{PayloadBatchingEnabled: true})
+	defer Configure(Configuration{})
+	assert.IsType(t, &HTTPSender{}, Config.Sender)
+
+	sender := &BatchSender{Linger: time.Hour}
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "a"}))
+	assert.ErrorIs(t, sender.Flush(context.Background()), ErrNoBatchEndpoint)
+}
+
+func TestConfigureFlushesPreviousBatchSender(t *testing.T) {
+	receiver, url := newBatchServer(t)
+	Configure(Configuration{PayloadBatchingEnabled: true, PayloadBatchEndpoint: url, PayloadBatchLinger: time.Hour})
+	defer Configure(Configuration{})
+
+	sendToTreblle(MetaData{ProjectID: "pending"})
+	assert.Empty(t, receiver.received())
+
+	// Nothing is still being delivered once Configure returns
+	Configure(Configuration{})
+	assert.Equal(t, [][]string{{"pending"}}, receiver.received())
+}
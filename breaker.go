@@ -0,0 +1,245 @@
+package treblle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCircuitFailureRatio = 0.5
+	defaultCircuitMinRequests  = 10
+	defaultCircuitWindow       = 30 * time.Second
+	defaultCircuitCooldown     = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned for payloads not sent because the circuit
+// breaker is open. They are spooled when a spool is configured.
+var ErrCircuitOpen = errors.New("treblle circuit breaker is open")
+
+// errDeliveryPanicked is recorded for deliveries that panicked
+var errDeliveryPanicked = errors.New("treblle delivery panicked")
+
+// CircuitState is the state of the circuit breaker around delivery
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // Payloads are sent
+	CircuitOpen     CircuitState = "open"      // Payloads are not sent until the cooldown passes
+	CircuitHalfOpen CircuitState = "half_open" // One payload probes whether delivery recovered
+)
+
+// CircuitBreakerStats describes the circuit breaker around delivery
+type CircuitBreakerStats struct {
+	State    CircuitState // Current state, CircuitClosed when the breaker is disabled
+	Opened   uint64       // Times the circuit opened
+	Closed   uint64       // Times the circuit closed again after a successful probe
+	Rejected uint64       // Payloads not sent while the circuit was open
+}
+
+// circuitBreaker stops delivery once the share of failed deliveries within
+// a window reaches the failure ratio, letting a single probe through after
+// each cooldown. A nil breaker lets everything through.
+type circuitBreaker struct {
+	failureRatio float64
+	minRequests  int
+	window       time.Duration
+	cooldown     time.Duration
+
+	mu          sync.Mutex
+	state       CircuitState
+	generation  uint64 // Incremented when the circuit opens, outdating deliveries under way
+	windowStart time.Time
+	successes   int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+
+	opened   atomic.Uint64
+	closed   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// newCircuitBreaker returns the breaker of the configuration, nil when disabled
+func newCircuitBreaker(config Configuration) *circuitBreaker {
+	if !config.CircuitBreakerEnabled {
+		return nil
+	}
+
+	b := &circuitBreaker{
+		failureRatio: config.CircuitFailureRatio,
+		minRequests:  config.CircuitMinRequests,
+		window:       config.CircuitWindow,
+		cooldown:     config.CircuitCooldown,
+		state:        CircuitClosed,
+		windowStart:  time.Now(),
+	}
+	if b.failureRatio <= 0 || b.failureRatio > 1 {
+		b.failureRatio = defaultCircuitFailureRatio
+	}
+	if b.minRequests <= 0 {
+		b.minRequests = defaultCircuitMinRequests
+	}
+	if b.window <= 0 {
+		b.window = defaultCircuitWindow
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = defaultCircuitCooldown
+	}
+	return b
+}
+
+// breakerTicket identifies a delivery allowed by the breaker
+type breakerTicket struct {
+	generation uint64
+	probe      bool
+}
+
+// guard runs deliver unless the circuit is open, recording its outcome even
+// when it panics
+func (b *circuitBreaker) guard(deliver func() error) (err error) {
+	ticket, ok := b.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+
+	panicked := true
+	defer func() {
+		if panicked {
+			b.record(ticket, errDeliveryPanicked)
+			return
+		}
+		b.record(ticket, err)
+	}()
+	err = deliver()
+	panicked = false
+	return err
+}
+
+// allow reports whether a delivery may be attempted, with the ticket its
+// outcome is recorded with. Once the cooldown passes, the first caller is
+// let through as the probe.
+func (b *circuitBreaker) allow() (breakerTicket, bool) {
+	if b == nil {
+		return breakerTicket{}, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.rejected.Add(1)
+			return breakerTicket{}, false
+		}
+		b.transition(CircuitHalfOpen)
+		b.probing = true
+		return breakerTicket{generation: b.generation, probe: true}, true
+	case CircuitHalfOpen:
+		if b.probing {
+			b.rejected.Add(1)
+			return breakerTicket{}, false
+		}
+		b.probing = true
+		return breakerTicket{generation: b.generation, probe: true}, true
+	default:
+		return breakerTicket{generation: b.generation}, true
+	}
+}
+
+// record counts the outcome of an allowed delivery. Payloads the endpoint
+// refused outright count as successes, the endpoint being up. Deliveries
+// that started before the circuit last opened are ignored, and so is
+// anything but the probe while half open.
+func (b *circuitBreaker) record(ticket breakerTicket, err error) {
+	if b == nil {
+		return
+	}
+	failed := err != nil && isSpoolable(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket.generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case CircuitHalfOpen:
+		if !ticket.probe {
+			return
+		}
+		b.probing = false
+		if failed {
+			b.open()
+			return
+		}
+		b.transition(CircuitClosed)
+		b.closed.Add(1)
+		b.resetWindow()
+	case CircuitClosed:
+		if time.Since(b.windowStart) > b.window {
+			b.resetWindow()
+		}
+		if failed {
+			b.failures++
+		} else {
+			b.successes++
+		}
+		total := b.successes + b.failures
+		if total >= b.minRequests && float64(b.failures)/float64(total) >= b.failureRatio {
+			b.open()
+		}
+	}
+}
+
+// open opens the circuit. Callers hold mu.
+func (b *circuitBreaker) open() {
+	b.transition(CircuitOpen)
+	b.generation++
+	b.openedAt = time.Now()
+	b.opened.Add(1)
+	b.resetWindow()
+}
+
+// resetWindow starts a new counting window. Callers hold mu.
+func (b *circuitBreaker) resetWindow() {
+	b.windowStart = time.Now()
+	b.successes = 0
+	b.failures = 0
+}
+
+// transition changes the state, logging it in debug mode. Callers hold mu.
+func (b *circuitBreaker) transition(state CircuitState) {
+	if Config.Debug {
+		fmt.Printf("Treblle circuit breaker: %s -> %s\n", b.state, state)
+	}
+	b.state = state
+}
+
+// stats returns the state and counters of the breaker
+func (b *circuitBreaker) stats() CircuitBreakerStats {
+	if b == nil {
+		return CircuitBreakerStats{State: CircuitClosed}
+	}
+
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+
+	return CircuitBreakerStats{
+		State:    state,
+		Opened:   b.opened.Load(),
+		Closed:   b.closed.Load(),
+		Rejected: b.rejected.Load(),
+	}
+}
+
+// GetCircuitBreakerStats returns the state and counters of the circuit
+// breaker around delivery
+func GetCircuitBreakerStats() CircuitBreakerStats {
+	return Config.breaker.stats()
+}
@@ -0,0 +1,204 @@
+package treblle
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// attempt runs a delivery failing with err through the breaker
+func attempt(b *circuitBreaker, err error) error {
+	return b.guard(func() error { return err })
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	b := newCircuitBreaker(Configuration{CircuitBreakerEnabled: true, CircuitMinRequests: 4, CircuitCooldown: 20 * time.Millisecond})
+	down := errors.New("connection refused")
+
+	// Below the minimum number of deliveries the circuit stays closed
+	for i := 0; i < 3; i++ {
+		require.Equal(t, down, attempt(b, down))
+	}
+	assert.Equal(t, CircuitClosed, b.stats().State)
+
+	require.NoError(t, attempt(b, nil))
+	assert.Equal(t, CircuitOpen, b.stats().State)
+	assert.ErrorIs(t, attempt(b, nil), ErrCircuitOpen)
+
+	// A failed probe opens the circuit again
+	time.Sleep(25 * time.Millisecond)
+	ticket, ok := b.allow()
+	require.True(t, ok)
+	assert.Equal(t, CircuitHalfOpen, b.stats().State)
+	_, ok = b.allow()
+	assert.False(t, ok, "a single probe at a time")
+	b.record(ticket, down)
+	assert.Equal(t, CircuitOpen, b.stats().State)
+
+	time.Sleep(25 * time.Millisecond)
+	require.NoError(t, attempt(b, nil))
+	assert.Equal(t, CircuitBreakerStats{State: CircuitClosed, Opened: 2, Closed: 1, Rejected: 2}, b.stats())
+}
+
+func TestCircuitBreakerIgnoresStaleOutcomes(t *testing.T) {
+	b := newCircuitBreaker(Configuration{CircuitBreakerEnabled: true, CircuitMinRequests: 1, CircuitCooldown: 10 * time.Millisecond})
+
+	// A delivery under way when the circuit opens
+	stale, ok := b.allow()
+	require.True(t, ok)
+	attempt(b, errors.New("timeout"))
+	require.Equal(t, CircuitOpen, b.stats().State)
+
+	time.Sleep(15 * time.Millisecond)
+	probe, ok := b.allow()
+	require.True(t, ok)
+
+	// Its success says nothing about the endpoint now
+	b.record(stale, nil)
+	assert.Equal(t, CircuitHalfOpen, b.stats().State)
+
+	b.record(probe, nil)
+	assert.Equal(t, CircuitClosed, b.stats().State)
+}
+
+func TestCircuitBreakerRecordsPanickingDeliveries(t *testing.T) {
+	b := newCircuitBreaker(Configuration{CircuitBreakerEnabled: true, CircuitMinRequests: 1, CircuitCooldown: 10 * time.Millisecond})
+	require.Error(t, attempt(b, errors.New("timeout")))
+
+	// The probe panics, the next one still gets through
+	time.Sleep(15 * time.Millisecond)
+	assert.Panics(t, func() { b.guard(func() error { panic("sender bug") }) })
+	assert.Equal(t, CircuitOpen, b.stats().State)
+
+	time.Sleep(15 * time.Millisecond)
+	require.NoError(t, attempt(b, nil))
+	assert.Equal(t, CircuitClosed, b.stats().State)
+}
+
+func TestCircuitBreakerCountsRefusedPayloadsAsDelivered(t *testing.T) {
+	b := newCircuitBreaker(Configuration{CircuitBreakerEnabled: true, CircuitMinRequests: 2})
+	refused := &sendError{err: errors.New("400 Bad Request"), status: 400}
+	for i := 0; i < 5; i++ {
+		require.Equal(t, refused, attempt(b, refused))
+	}
+	assert.Equal(t, CircuitClosed, b.stats().State)
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := newCircuitBreaker(Configuration{CircuitBreakerEnabled: true, CircuitMinRequests: 2, CircuitWindow: 10 * time.Millisecond})
+	attempt(b, errors.New("timeout"))
+	time.Sleep(15 * time.Millisecond)
+
+	// The failure of the previous window is forgotten
+	attempt(b, nil)
+	attempt(b, nil)
+	assert.Equal(t, CircuitClosed, b.stats().State)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	Configure(Configuration{})
+	assert.Nil(t, Config.breaker)
+	assert.Equal(t, CircuitBreakerStats{State: CircuitClosed}, GetCircuitBreakerStats())
+}
+
+func TestOpenCircuitSpoolsPayloadsWithoutSending(t *testing.T) {
+	dir := t.TempDir()
+	sender := &flakySender{}
+	var attempts atomic.Int32
+	Configure(Configuration{
+		Sender: SenderFunc(func(ctx context.Context, payload MetaData) error {
+			attempts.Add(1)
+			return sender.Send(ctx, payload)
+		}),
+		CircuitBreakerEnabled: true,
+		CircuitMinRequests:    2,
+		CircuitCooldown:       20 * time.Millisecond,
+		SpoolDir:              dir,
+		SpoolRetryInterval:    50 * time.Millisecond,
+	})
+	defer Configure(Configuration{})
+
+	for _, project := range []string{"one", "two", "three", "four"} {
+		require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{ProjectID: project}))
+	}
+	assert.Equal(t, int32(2), attempts.Load())
+	assert.Equal(t, uint64(4), Config.spool.written.Load())
+	stats := GetCircuitBreakerStats()
+	assert.Equal(t, CircuitOpen, stats.State)
+	assert.Equal(t, uint64(1), stats.Opened)
+	assert.GreaterOrEqual(t, stats.Rejected, uint64(2))
+
+	// Replaying the spool probes the endpoint and closes the circuit
+	sender.up.Store(true)
+	require.Eventually(t, func() bool { return len(sender.Payloads()) == 4 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, CircuitClosed, GetCircuitBreakerStats().State)
+	assert.Equal(t, uint64(1), GetCircuitBreakerStats().Closed)
+}
+
+func TestOpenCircuitWithoutSpool(t *testing.T) {
+	Configure(Configuration{
+		Sender:                SenderFunc(func(ctx context.Context, payload MetaData) error { return errors.New("timeout") }),
+		CircuitBreakerEnabled: true,
+		CircuitMinRequests:    1,
+	})
+	defer Configure(Configuration{})
+
+	assert.EqualError(t, sendToTreblleWithContext(context.Background(), MetaData{}), "timeout")
+	assert.ErrorIs(t, sendToTreblleWithContext(context.Background(), MetaData{}), ErrCircuitOpen)
+}
+
+func TestOpenCircuitSpoolsBatches(t *testing.T) {
+	dir := t.TempDir()
+	receiver, url := newBatchServer(t)
+	Configure(Configuration{
+		CircuitBreakerEnabled: true,
+		SpoolDir:              dir,
+		SpoolRetryInterval:    time.Hour,
+		CircuitCooldown:       time.Hour,
+	})
+	defer Configure(Configuration{})
+
+	// Force the circuit open
+	Config.breaker.mu.Lock()
+	Config.breaker.open()
+	Config.breaker.mu.Unlock()
+
+	sender := &BatchSender{Endpoint: url, Linger: time.Hour}
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "a"}))
+	require.NoError(t, sender.Flush(context.Background()))
+	assert.Empty(t, receiver.received())
+	assert.Equal(t, uint64(1), Config.spool.written.Load())
+}
+
+func TestPanickingSenderDoesNotWedgeTheCircuit(t *testing.T) {
+	var panics atomic.Bool
+	panics.Store(true)
+	Configure(Configuration{
+		Sender: SenderFunc(func(ctx context.Context, payload MetaData) error {
+			if panics.Load() {
+				panic("sender bug")
+			}
+			return nil
+		}),
+		CircuitBreakerEnabled: true,
+		CircuitMinRequests:    1,
+		CircuitCooldown:       10 * time.Millisecond,
+	})
+	defer Configure(Configuration{})
+
+	assert.Panics(t, func() { sendToTreblleWithContext(context.Background(), MetaData{}) })
+	require.Equal(t, CircuitOpen, GetCircuitBreakerStats().State)
+
+	time.Sleep(15 * time.Millisecond)
+	assert.Panics(t, func() { sendToTreblleWithContext(context.Background(), MetaData{}) })
+
+	panics.Store(false)
+	time.Sleep(15 * time.Millisecond)
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{}))
+	assert.Equal(t, CircuitClosed, GetCircuitBreakerStats().State)
+}
@@ -0,0 +1,230 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// BodyCodec turns a request or response body into a tree of
+// map[string]interface{}, []interface{} and scalar values that can be masked,
+// and encodes the masked tree into the JSON reported to Treblle
+type BodyCodec interface {
+	Decode(body []byte) (interface{}, error)
+	Encode(data interface{}) (json.RawMessage, error)
+}
+
+var (
+	bodyCodecsMu sync.RWMutex
+	bodyCodecs   = map[string]BodyCodec{
+		"application/json":                  JSONCodec{},
+		"*/*+json":                          JSONCodec{},
+		"application/x-ndjson":              NDJSONCodec{},
+		"application/ndjson":                NDJSONCodec{},
+		"application/jsonl":                 NDJSONCodec{},
+		"application/xml":                   XMLCodec{},
+		"text/xml":                          XMLCodec{},
+		"*/*+xml":                           XMLCodec{},
+		"application/x-www-form-urlencoded": FormCodec{},
+	}
+)
+
+// RegisterBodyCodec registers codec for a media type such as "application/json".
+// The media type may use a wildcard subtype with a structured syntax suffix,
+// like "application/*+json", or "*/*+json" to match the suffix under any
+// type. A plain "type/*" wildcard is used as the last resort for that type.
+func RegisterBodyCodec(mediaType string, codec BodyCodec) {
+	bodyCodecsMu.Lock()
+	defer bodyCodecsMu.Unlock()
+	bodyCodecs[strings.ToLower(mediaType)] = codec
+}
+
+// lookupBodyCodec returns the codec registered for a Content-Type header
+// value, preferring exact matches over suffix and type wildcards
+func lookupBodyCodec(contentType string) (BodyCodec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	candidates := []string{mediaType}
+	if typ, subtype, ok := strings.Cut(mediaType, "/"); ok {
+		if i := strings.LastIndex(subtype, "+"); i >= 0 {
+			suffix := subtype[i:]
+			candidates = append(candidates, typ+"/*"+suffix, "*/*"+suffix)
+		}
+		candidates = append(candidates, typ+"/*")
+	}
+
+	bodyCodecsMu.RLock()
+	defer bodyCodecsMu.RUnlock()
+	for _, candidate := range candidates {
+		if codec, ok := bodyCodecs[candidate]; ok {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// getMaskedBody decodes body with codec, masks it and encodes it for Treblle
+func getMaskedBody(codec BodyCodec, body []byte) (json.RawMessage, error) {
+	data, err := codec.Decode(body)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Encode(maskData(data))
+}
+
+// JSONCodec handles JSON documents
+type JSONCodec struct{}
+
+func (JSONCodec) Decode(body []byte) (interface{}, error) {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (JSONCodec) Encode(data interface{}) (json.RawMessage, error) {
+	return json.Marshal(data)
+}
+
+// NDJSONCodec handles newline-delimited JSON, reported as a JSON array
+type NDJSONCodec struct{}
+
+func (NDJSONCodec) Decode(body []byte) (interface{}, error) {
+	records := make([]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for line := 1; scanner.Scan(); line++ {
+		record := bytes.TrimSpace(scanner.Bytes())
+		if len(record) == 0 {
+			continue
+		}
+		var data interface{}
+		if err := json.Unmarshal(record, &data); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, data)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (NDJSONCodec) Encode(data interface{}) (json.RawMessage, error) {
+	return json.Marshal(data)
+}
+
+// XMLCodec handles XML documents. Elements become objects keyed by element
+// name, attributes are prefixed with "@", mixed text is kept under "#text"
+// and repeated elements become arrays.
+type XMLCodec struct{}
+
+func (XMLCodec) Decode(body []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			value, err := decodeXMLElement(decoder, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: value}, nil
+		}
+	}
+}
+
+func (XMLCodec) Encode(data interface{}) (json.RawMessage, error) {
+	return json.Marshal(data)
+}
+
+func decodeXMLElement(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	node := make(map[string]interface{})
+	for _, attr := range start.Attr {
+		node["@"+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(decoder, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := node[name].(type) {
+			case nil:
+				node[name] = child
+			case []interface{}:
+				node[name] = append(existing, child)
+			default:
+				node[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			content := strings.TrimSpace(text.String())
+			if len(node) == 0 {
+				return content, nil
+			}
+			if content != "" {
+				node["#text"] = content
+			}
+			return node, nil
+		}
+	}
+}
+
+// FormCodec handles application/x-www-form-urlencoded bodies. Keys with a
+// single value become strings and repeated keys become arrays, so fields are
+// masked exactly like JSON keys.
+type FormCodec struct{}
+
+func (FormCodec) Decode(body []byte) (interface{}, error) {
+	// Like http.Request.ParseForm, keep the well-formed pairs when some are
+	// malformed and only fail when nothing could be decoded
+	values, err := url.ParseQuery(string(body))
+	if err != nil && len(values) == 0 {
+		return nil, err
+	}
+	return formValuesToMap(values), nil
+}
+
+func (FormCodec) Encode(data interface{}) (json.RawMessage, error) {
+	return json.Marshal(data)
+}
+
+// formValuesToMap converts url.Values into a maskable tree
+func formValuesToMap(values url.Values) map[string]interface{} {
+	data := make(map[string]interface{}, len(values))
+	for key, list := range values {
+		if len(list) == 1 {
+			data[key] = list[0]
+			continue
+		}
+		items := make([]interface{}, len(list))
+		for i, value := range list {
+			items[i] = value
+		}
+		data[key] = items
+	}
+	return data
+}
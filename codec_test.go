@@ -0,0 +1,155 @@
+package treblle
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nopBody(s string) io.ReadCloser {
+	return io.NopCloser(strings.NewReader(s))
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Decode(body []byte) (interface{}, error) {
+	return map[string]interface{}{"text": strings.ToUpper(string(body))}, nil
+}
+
+func (upperCodec) Encode(data interface{}) (json.RawMessage, error) {
+	return json.Marshal(data)
+}
+
+func TestLookupBodyCodec(t *testing.T) {
+	testCases := map[string]struct {
+		contentType string
+		expected    BodyCodec
+	}{
+		"exact-json":       {"application/json", JSONCodec{}},
+		"json-charset":     {"application/json; charset=utf-8", JSONCodec{}},
+		"problem-json":     {"application/problem+json", JSONCodec{}},
+		"vnd-api-json":     {"application/vnd.api+json", JSONCodec{}},
+		"upper-case":       {"Application/JSON", JSONCodec{}},
+		"ndjson":           {"application/x-ndjson", NDJSONCodec{}},
+		"xml":              {"text/xml; charset=utf-8", XMLCodec{}},
+		"atom-xml":         {"application/atom+xml", XMLCodec{}},
+		"form":             {"application/x-www-form-urlencoded", FormCodec{}},
+		"unknown":          {"application/octet-stream", nil},
+		"invalid":          {"not a media type;;", nil},
+		"empty":            {"", nil},
+		"plain-text":       {"text/plain", nil},
+		"json-not-suffix":  {"application/jsonish", nil},
+		"suffix-not-match": {"application/vnd.custom+yaml", nil},
+	}
+
+	for tn, tc := range testCases {
+		codec, ok := lookupBodyCodec(tc.contentType)
+		assert.Equal(t, tc.expected != nil, ok, tn)
+		assert.Equal(t, tc.expected, codec, tn)
+	}
+}
+
+func TestRegisterBodyCodec(t *testing.T) {
+	RegisterBodyCodec("text/x-upper", upperCodec{})
+	RegisterBodyCodec("application/*+custom", upperCodec{})
+	defer func() {
+		bodyCodecsMu.Lock()
+		delete(bodyCodecs, "text/x-upper")
+		delete(bodyCodecs, "application/*+custom")
+		bodyCodecsMu.Unlock()
+	}()
+
+	codec, ok := lookupBodyCodec("text/x-upper")
+	require.True(t, ok)
+	masked, err := getMaskedBody(codec, []byte("hello"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"text":"HELLO"}`, string(masked))
+
+	_, ok = lookupBodyCodec("application/vnd.acme+custom")
+	assert.True(t, ok)
+}
+
+func TestBuiltInCodecsMask(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+
+	testCases := map[string]struct {
+		codec    BodyCodec
+		body     string
+		expected string
+	}{
+		"json": {
+			codec:    JSONCodec{},
+			body:     `{"user":"bob","password":"secret"}`,
+			expected: `{"user":"bob","password":"*********"}`,
+		},
+		"ndjson": {
+			codec:    NDJSONCodec{},
+			body:     "{\"password\":\"a\"}\n\n{\"id\":2}\n",
+			expected: `[{"password":"*********"},{"id":2}]`,
+		},
+		"xml": {
+			codec:    XMLCodec{},
+			body:     `<user id="7"><name>bob</name><password>secret</password><role>a</role><role>b</role></user>`,
+			expected: `{"user":{"@id":"7","name":"bob","password":"*********","role":["a","b"]}}`,
+		},
+		"form": {
+			codec:    FormCodec{},
+			body:     `user=bob&password=secret&scope=read&scope=write`,
+			expected: `{"user":"bob","password":"*********","scope":["read","write"]}`,
+		},
+	}
+
+	for tn, tc := range testCases {
+		masked, err := getMaskedBody(tc.codec, []byte(tc.body))
+		require.NoError(t, err, tn)
+		assert.JSONEq(t, tc.expected, string(masked), tn)
+	}
+}
+
+func TestCodecDecodeErrors(t *testing.T) {
+	_, err := NDJSONCodec{}.Decode([]byte("{\"id\":1}\n{broken"))
+	assert.ErrorContains(t, err, "line 2")
+
+	_, err = XMLCodec{}.Decode([]byte("<open>"))
+	assert.Error(t, err)
+}
+
+func TestResponseMaskingUsesCodecs(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+
+	for _, contentType := range []string{
+		"application/json; charset=utf-8",
+		"application/problem+json",
+		"application/vnd.api+json",
+	} {
+		w := newResponseWriter(httptest.NewRecorder(), maxResponseSize)
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(`{"password":"secret"}`))
+
+		responseInfo := getResponseInfo(w, time.Now(), NewErrorProvider())
+		assert.JSONEq(t, `{"password":"*********"}`, string(responseInfo.Body), contentType)
+	}
+}
+
+func TestRequestBodyWithoutCodec(t *testing.T) {
+	errorProvider := NewErrorProvider()
+
+	body := newRequestBody(nopBody("plain text"), 1024)
+	io.ReadAll(body)
+	masked, _, _ := body.info(http.Header{"Content-Type": {"text/plain"}}, -1, errorProvider)
+	assert.Equal(t, `"plain text"`, string(masked))
+
+	body = newRequestBody(nopBody("\x00\x01"), 1024)
+	io.ReadAll(body)
+	masked, _, _ = body.info(http.Header{"Content-Type": {"application/octet-stream"}}, -1, errorProvider)
+	assert.Equal(t, `{}`, string(masked))
+
+	assert.Empty(t, errorProvider.GetErrors())
+}
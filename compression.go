@@ -0,0 +1,46 @@
+package treblle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+)
+
+// Define the default size from which payloads are gzipped
+const defaultGzipMinSize = 1024
+
+// gzipPayload compresses a marshalled payload at level
+func gzipPayload(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressPayload returns data gzipped when compression is enabled and data
+// is large enough, nil otherwise
+func compressPayload(data []byte) []byte {
+	if !Config.GzipPayloads || len(data) < Config.GzipMinSize {
+		return nil
+	}
+	compressed, err := gzipPayload(data, Config.GzipLevel)
+	if err != nil || len(compressed) >= len(data) {
+		return nil
+	}
+	return compressed
+}
+
+// isGzipRejected reports whether an endpoint refused a gzipped payload,
+// answering 415 or failing to read it with 400
+func isGzipRejected(err error) bool {
+	failure, ok := err.(*sendError)
+	return ok && (failure.status == http.StatusUnsupportedMediaType || failure.status == http.StatusBadRequest)
+}
@@ -0,0 +1,126 @@
+package treblle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressPayload(t *testing.T) {
+	large := []byte(strings.Repeat(`{"key":"value"}`, 200))
+
+	Configure(Configuration{})
+	assert.Nil(t, compressPayload(large), "compression is opt-in")
+
+	Configure(Configuration{GzipPayloads: true, GzipLevel: 42})
+	defer Configure(Configuration{})
+	assert.Equal(t, gzip.DefaultCompression, Config.GzipLevel)
+	assert.Equal(t, defaultGzipMinSize, Config.GzipMinSize)
+	assert.Nil(t, compressPayload([]byte(`{"small":true}`)))
+
+	compressed := compressPayload(large)
+	require.NotNil(t, compressed)
+	assert.Less(t, len(compressed), len(large))
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, large, decoded)
+}
+
+// payloadReceiver decodes the payloads it receives and refuses gzipped
+// ones with refuseGzip
+type payloadReceiver struct {
+	mu         sync.Mutex
+	refuseGzip int
+	encodings  []string
+	payloads   []MetaData
+}
+
+func (p *payloadReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	encoding := r.Header.Get("Content-Encoding")
+	p.encodings = append(p.encodings, encoding)
+	if encoding == "gzip" && p.refuseGzip != 0 {
+		w.WriteHeader(p.refuseGzip)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if encoding == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = reader
+	}
+	var payload MetaData
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.payloads = append(p.payloads, payload)
+}
+
+func TestHTTPSenderGzipsPayloads(t *testing.T) {
+	Configure(Configuration{GzipPayloads: true, GzipMinSize: 10})
+	defer Configure(Configuration{})
+
+	receiver := &payloadReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	payload := MetaData{ProjectID: strings.Repeat("project", 50)}
+	require.NoError(t, (&HTTPSender{Endpoint: server.URL}).Send(context.Background(), payload))
+	assert.Equal(t, []string{"gzip"}, receiver.encodings)
+	require.Len(t, receiver.payloads, 1)
+	assert.Equal(t, payload.ProjectID, receiver.payloads[0].ProjectID)
+}
+
+func TestHTTPSenderFallsBackWhenGzipRefused(t *testing.T) {
+	Configure(Configuration{GzipPayloads: true, GzipMinSize: 10})
+	defer Configure(Configuration{})
+
+	for _, status := range []int{http.StatusUnsupportedMediaType, http.StatusBadRequest} {
+		receiver := &payloadReceiver{refuseGzip: status}
+		server := httptest.NewServer(receiver)
+
+		sender := &HTTPSender{Endpoint: server.URL}
+		payload := MetaData{ProjectID: strings.Repeat("project", 50)}
+		require.NoError(t, sender.Send(context.Background(), payload))
+		require.NoError(t, sender.Send(context.Background(), payload))
+
+		// Once refused, the endpoint is sent plain JSON straight away
+		assert.Equal(t, []string{"gzip", "", ""}, receiver.encodings, status)
+		assert.Len(t, receiver.payloads, 2)
+		server.Close()
+	}
+}
+
+func TestHTTPSenderKeepsGzipWhenPlainPayloadRefused(t *testing.T) {
+	Configure(Configuration{GzipPayloads: true, GzipMinSize: 10, MaxSendRetries: -1})
+	defer Configure(Configuration{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sender := &HTTPSender{Endpoint: server.URL}
+	assert.Error(t, sender.Send(context.Background(), MetaData{ProjectID: strings.Repeat("project", 50)}))
+	_, rejected := sender.gzipRejected.Load(server.URL)
+	assert.False(t, rejected)
+}
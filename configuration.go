@@ -1,6 +1,11 @@
 package treblle
 
 import (
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -16,17 +21,74 @@ type Configuration struct {
 	AdditionalFieldsToMask  []string
 	DefaultFieldsToMask     []string
 	MaskingEnabled          bool
-	Endpoint                string        // Custom endpoint for testing
-	BatchErrorEnabled       bool          // Enable batch error collection
-	BatchErrorSize          int           // Size of error batch before sending
-	BatchFlushInterval      time.Duration // Interval to flush errors if batch size not reached
-	SDKName                 string        // Defaults to "go"
-	SDKVersion              float64       // Defaults to 2.0
-	AsyncProcessingEnabled  bool          // Enable asynchronous request processing
-	MaxConcurrentProcessing int           // Maximum number of concurrent async operations (default: 10)
-	AsyncShutdownTimeout    time.Duration // Timeout for async shutdown (default: 5s)
-	IgnoredEnvironments     []string      // Environments where Treblle does not track requests
-	Debug                   bool          // Enable debug mode to see what's being sent to Treblle
+	Endpoint                string            // Custom endpoint for testing
+	Sender                  Sender            // Where payloads are delivered, e.g. a MemorySender in tests (default: the Treblle API over HTTP)
+	SendTimeout             time.Duration     // Total time allowed to deliver a payload, retries included (default: 5s)
+	MaxSendRetries          int               // Retries of a payload failing with a network error, 429 or 5xx, negative disables them (default: 3)
+	RetryBaseDelay          time.Duration     // Backoff before the first retry, doubled with jitter for each further one (default: 100ms)
+	RetryMaxDelay           time.Duration     // Longest backoff between retries, Retry-After excepted (default: 2s)
+	PayloadBatchingEnabled  bool              // Post payloads in batches, ignored when Sender is set
+	PayloadBatchSize        int               // Payloads per batch (default: 100)
+	PayloadBatchMaxBytes    int               // Largest batch before compression (default: 1MB)
+	PayloadBatchLinger      time.Duration     // Longest a payload waits for its batch to fill (default: 1s)
+	PayloadBatchEndpoint    string            // Endpoint accepting batches, required for batching
+	PayloadBatchFormat      BatchFormat       // Batch encoding, BatchJSONArray or BatchNDJSON (default: BatchJSONArray)
+	SpoolDir                string            // Directory keeping payloads that could not be delivered or queued, replayed on recovery and on the next start (default: disabled)
+	SpoolMaxBytes           int64             // Disk space of the spool, the oldest payloads are deleted first (default: 100MB)
+	SpoolMaxAge             time.Duration     // Age after which spooled payloads are deleted (default: 24h)
+	SpoolSegmentSize        int64             // Size of the spool segment files (default: 4MB)
+	SpoolRetryInterval      time.Duration     // How often the spool retries delivery while it holds payloads (default: 30s)
+	CircuitBreakerEnabled   bool              // Stop sending payloads while most deliveries fail, spooling or dropping them instead
+	CircuitFailureRatio     float64           // Share of failed deliveries within CircuitWindow opening the circuit (default: 0.5)
+	CircuitMinRequests      int               // Deliveries within CircuitWindow before the circuit may open (default: 10)
+	CircuitWindow           time.Duration     // Window over which delivery failures are counted (default: 30s)
+	CircuitCooldown         time.Duration     // How long the circuit stays open before a single payload probes the endpoint (default: 30s)
+	GzipPayloads            bool              // Gzip payloads sent over HTTP, falling back to plain JSON for endpoints refusing them
+	GzipMinSize             int               // Smallest payload gzipped, in bytes (default: 1KB)
+	GzipLevel               int               // Compression level, from 1 (fastest) to 9 (smallest) (default: gzip.DefaultCompression)
+	HTTPClient              *http.Client      // Client delivering payloads, used as is (default: a shared client built from the options below)
+	HTTPTransport           http.RoundTripper // Transport delivering payloads when HTTPClient is not set
+	ProxyURL                string            // Egress proxy, e.g. "http://proxy.internal:3128" (default: HTTP_PROXY and HTTPS_PROXY)
+	TLSConfig               *tls.Config       // Base TLS config of the delivery transport
+	CACertFile              string            // PEM file of extra CAs trusted besides the system pool
+	ClientCertFile          string            // PEM client certificate for mutual TLS, with ClientKeyFile
+	ClientKeyFile           string            // PEM private key of ClientCertFile
+	DialTimeout             time.Duration     // Timeout of opening a connection (default: 30s)
+	TLSHandshakeTimeout     time.Duration     // Timeout of the TLS handshake (default: 10s)
+	ResponseHeaderTimeout   time.Duration     // Timeout waiting for response headers once a payload is written (default: none, the send timeout applies)
+	MaxIdleConns            int               // Idle connections kept across all hosts (default: 100)
+	MaxIdleConnsPerHost     int               // Idle connections kept per host (default: 2)
+	BatchErrorEnabled       bool              // Enable batch error collection
+	BatchErrorSize          int               // Size of error batch before sending
+	BatchFlushInterval      time.Duration     // Interval to flush errors if batch size not reached
+	SDKName                 string            // Defaults to "go"
+	SDKVersion              float64           // Defaults to 2.0
+	AsyncProcessingEnabled  bool              // Enable asynchronous request processing
+	MaxConcurrentProcessing int               // Maximum number of concurrent async operations (default: 10)
+	AsyncShutdownTimeout    time.Duration     // Timeout for async shutdown (default: 5s)
+	AsyncQueueSize          int               // Payloads queued for the async workers (default: 1000)
+	AsyncQueueMaxBytes      int64             // Approximate memory budget of the queued payloads (default: 32MB)
+	AsyncOverflowPolicy     OverflowPolicy    // What happens to payloads arriving at a full queue (default: OverflowDropNewest)
+	AsyncEnqueueTimeout     time.Duration     // How long OverflowBlock waits for room in the queue (default: 100ms)
+	IgnoredEnvironments     []string          // Environments where Treblle does not track requests
+	MaskRules               []MaskRule        // Path, key pattern and value detector masking rules, checked before the masked field names
+	PathMaskRules           []PathMaskRule    // Rules masking segments of the reported URL path, e.g. tokens and emails
+	CookieMaskRules         []CookieMaskRule  // Per-cookie masking of Cookie and Set-Cookie headers, the first match wins (default: all values masked)
+	MaskHashSalt            string            // Salt of MaskHash tokens (default: random, tokens only match within one process)
+	HeaderAllowList         []string          // Only these headers are reported when set (default: all headers)
+	HeaderDenyList          []string          // Headers never reported
+	Rules                   []Rule            // Rules skipping requests or reporting them without bodies, the first match wins
+	SampleRate              *float64          // Fraction of requests reported, from 0 to 1. At 0 only errors and slow requests are (default: nil, every request)
+	RouteSampleRates        []RouteSampleRate // Sample rates of specific routes, the first match wins over SampleRate
+	SampleKeepSlowerThan    time.Duration     // Report requests slower than this whatever the sample rate (default: 0, disabled)
+	SampleIDHeaders         []string          // Headers with the request or trace ID sampling is keyed on (default: traceparent, X-B3-TraceId, X-Request-ID, X-Correlation-ID)
+	ExpvarEnabled           bool              // Publish Stats() as the "treblle" expvar
+	Debug                   bool              // Enable debug mode to see what's being sent to Treblle
+	SSECaptureEvents        int               // Number of Server-Sent Events captured per stream (default: 0, summary only)
+	MaxRequestCaptureSize   int               // Maximum request body bytes kept for masking (default: 2MB)
+	MaxResponseCaptureSize  int               // Maximum response body bytes kept for masking (default: 2MB)
+	HashMultipartFiles      bool              // Report a SHA-256 digest of uploaded files (default: false)
+	MaxDecompressionRatio   int               // Decompressed bodies are cut off at this many times their compressed size (default: 100)
 }
 
 // internalConfiguration is used for communication with Treblle API and contains optimizations
@@ -37,6 +99,18 @@ type internalConfiguration struct {
 	DefaultFieldsToMask     []string
 	MaskingEnabled          bool
 	Endpoint                string
+	Sender                  Sender
+	SendTimeout             time.Duration
+	MaxSendRetries          int
+	RetryBaseDelay          time.Duration
+	RetryMaxDelay           time.Duration
+	GzipPayloads            bool
+	GzipMinSize             int
+	GzipLevel               int
+	httpClient              *http.Client
+	httpTransport           *http.Transport // Built by Configure, its idle connections closed when replaced
+	spool                   *spool
+	breaker                 *circuitBreaker
 	FieldsMap               map[string]bool
 	serverInfo              ServerInfo
 	languageInfo            LanguageInfo
@@ -47,10 +121,42 @@ type internalConfiguration struct {
 	AsyncProcessingEnabled  bool
 	MaxConcurrentProcessing int
 	AsyncShutdownTimeout    time.Duration
+	AsyncQueueSize          int
+	AsyncQueueMaxBytes      int64
+	AsyncOverflowPolicy     OverflowPolicy
+	AsyncEnqueueTimeout     time.Duration
 	IgnoredEnvironments     []string
+	masking                 *maskingEngine
+	PathMaskRules           []PathMaskRule
+	CookieMaskRules         []CookieMaskRule
+	headerAllowList         map[string]bool
+	headerDenyList          map[string]bool
+	Rules                   []Rule
+	SampleRate              float64
+	RouteSampleRates        []RouteSampleRate
+	SampleKeepSlowerThan    time.Duration
+	SampleIDHeaders         []string
+	SSECaptureEvents        int
+	MaxRequestCaptureSize   int
+	MaxResponseCaptureSize  int
+	HashMultipartFiles      bool
+	MaxDecompressionRatio   int
 }
 
 func Configure(config Configuration) {
+	// Send what a previous batching sender still holds while the settings
+	// it delivers with are unchanged
+	if previous, ok := Config.Sender.(*BatchSender); ok {
+		flushSender(previous)
+	}
+
+	// Stop replaying the previous spool before changing the settings it
+	// replays with
+	if Config.spool != nil {
+		Config.spool.close()
+		Config.spool = nil
+	}
+
 	if config.SDK_TOKEN != "" {
 		Config.APIKey = config.SDK_TOKEN
 	}
@@ -61,9 +167,74 @@ func Configure(config Configuration) {
 		Config.Endpoint = config.Endpoint
 	}
 
+	// Deliver payloads to the Treblle API unless told otherwise
+	Config.Sender = config.Sender
+	if Config.Sender == nil {
+		// The payload endpoints take a single payload per request
+		if config.PayloadBatchingEnabled && config.PayloadBatchEndpoint == "" {
+			fmt.Println("Treblle: ignoring PayloadBatchingEnabled without a PayloadBatchEndpoint")
+		}
+		if config.PayloadBatchingEnabled && config.PayloadBatchEndpoint != "" {
+			Config.Sender = newBatchSender(config)
+		} else {
+			Config.Sender = &HTTPSender{}
+		}
+	}
+
+	// Configure payload compression
+	Config.GzipPayloads = config.GzipPayloads
+	Config.GzipMinSize = config.GzipMinSize
+	if Config.GzipMinSize <= 0 {
+		Config.GzipMinSize = defaultGzipMinSize
+	}
+	Config.GzipLevel = config.GzipLevel
+	if Config.GzipLevel < gzip.BestSpeed || Config.GzipLevel > gzip.BestCompression {
+		Config.GzipLevel = gzip.DefaultCompression
+	}
+
+	// Build the client shared by all deliveries, closing the idle
+	// connections of the transport it replaces
+	previousTransport := Config.httpTransport
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		fmt.Printf("Treblle: ignoring HTTP client options: %v\n", err)
+		httpClient = defaultHTTPClient
+	}
+	Config.httpClient = httpClient
+	Config.httpTransport = nil
+	if err == nil && config.HTTPClient == nil && config.HTTPTransport == nil {
+		Config.httpTransport, _ = httpClient.Transport.(*http.Transport)
+	}
+	if previousTransport != nil {
+		previousTransport.CloseIdleConnections()
+	}
+
+	// Configure delivery retries
+	Config.SendTimeout = config.SendTimeout
+	if Config.SendTimeout <= 0 {
+		Config.SendTimeout = timeoutDuration
+	}
+	Config.MaxSendRetries = config.MaxSendRetries
+	if Config.MaxSendRetries == 0 {
+		Config.MaxSendRetries = defaultMaxSendRetries
+	}
+	Config.RetryBaseDelay = config.RetryBaseDelay
+	if Config.RetryBaseDelay <= 0 {
+		Config.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	Config.RetryMaxDelay = config.RetryMaxDelay
+	if Config.RetryMaxDelay <= 0 {
+		Config.RetryMaxDelay = defaultRetryMaxDelay
+	}
+
 	// Set debug mode
 	Config.Debug = config.Debug
 
+	// Publish the SDK's own stats
+	if config.ExpvarEnabled {
+		publishExpvar()
+	}
+
 	// Initialize server and language info
 	Config.serverInfo = GetServerInfo(nil)
 	Config.languageInfo = GetLanguageInfo()
@@ -101,6 +272,40 @@ func Configure(config Configuration) {
 	if Config.AsyncShutdownTimeout <= 0 {
 		Config.AsyncShutdownTimeout = 5 * time.Second
 	}
+	Config.AsyncQueueSize = config.AsyncQueueSize
+	if Config.AsyncQueueSize <= 0 {
+		Config.AsyncQueueSize = defaultAsyncQueueSize
+	}
+	Config.AsyncQueueMaxBytes = config.AsyncQueueMaxBytes
+	if Config.AsyncQueueMaxBytes <= 0 {
+		Config.AsyncQueueMaxBytes = defaultAsyncQueueMaxBytes
+	}
+	Config.AsyncOverflowPolicy = config.AsyncOverflowPolicy
+	if Config.AsyncOverflowPolicy == "" {
+		Config.AsyncOverflowPolicy = OverflowDropNewest
+	}
+	Config.AsyncEnqueueTimeout = config.AsyncEnqueueTimeout
+	if Config.AsyncEnqueueTimeout <= 0 {
+		Config.AsyncEnqueueTimeout = defaultAsyncEnqueueTimeout
+	}
+
+	// Configure Server-Sent Events tracking
+	Config.SSECaptureEvents = config.SSECaptureEvents
+
+	// Configure request body capture
+	Config.MaxRequestCaptureSize = config.MaxRequestCaptureSize
+	if Config.MaxRequestCaptureSize <= 0 {
+		Config.MaxRequestCaptureSize = defaultMaxRequestSize
+	}
+	Config.MaxResponseCaptureSize = config.MaxResponseCaptureSize
+	if Config.MaxResponseCaptureSize <= 0 {
+		Config.MaxResponseCaptureSize = maxResponseSize
+	}
+	Config.HashMultipartFiles = config.HashMultipartFiles
+	Config.MaxDecompressionRatio = config.MaxDecompressionRatio
+	if Config.MaxDecompressionRatio <= 0 {
+		Config.MaxDecompressionRatio = defaultMaxDecompressionRatio
+	}
 
 	// Initialize batch error collector if enabled
 	if config.BatchErrorEnabled {
@@ -133,7 +338,44 @@ func Configure(config Configuration) {
 		Config.IgnoredEnvironments = getEnvAsSlice("TREBLLE_IGNORED_ENV", defaultIgnoredEnvs)
 	}
 
+	// Compile the masking rules
+	Config.masking = newMaskingEngine(config.MaskRules, config.MaskHashSalt)
+	Config.PathMaskRules = config.PathMaskRules
+	Config.CookieMaskRules = config.CookieMaskRules
+
+	// Headers reported to Treblle
+	Config.headerAllowList = newHeaderSet(config.HeaderAllowList)
+	Config.headerDenyList = newHeaderSet(config.HeaderDenyList)
+
+	// Rules deciding which requests are reported
+	Config.Rules = config.Rules
+
+	// Configure sampling
+	Config.SampleRate = 1
+	if rate := config.SampleRate; rate != nil {
+		Config.SampleRate = math.Min(math.Max(*rate, 0), 1)
+	}
+	Config.RouteSampleRates = config.RouteSampleRates
+	Config.SampleKeepSlowerThan = config.SampleKeepSlowerThan
+	Config.SampleIDHeaders = config.SampleIDHeaders
+	if len(Config.SampleIDHeaders) == 0 {
+		Config.SampleIDHeaders = defaultSampleIDHeaders
+	}
+
 	Config.FieldsMap = generateFieldsToMask(Config.DefaultFieldsToMask, Config.AdditionalFieldsToMask)
+
+	// Guard delivery with a circuit breaker
+	Config.breaker = newCircuitBreaker(config)
+
+	// Open the spool, replaying what a previous process left in it
+	if config.SpoolDir != "" {
+		spool, err := openSpool(config)
+		if err != nil {
+			fmt.Printf("Treblle: spool disabled: %v\n", err)
+		} else {
+			Config.spool = spool
+		}
+	}
 }
 
 func getEnvMaskedFields() []string {
@@ -149,6 +391,8 @@ func getDefaultFieldsToMask() []string {
 		"password",
 		"pwd",
 		"secret",
+		"client_secret",
+		"clientSecret",
 		"password_confirmation",
 		"passwordConfirmation",
 		"cc",
@@ -164,6 +408,8 @@ func getDefaultFieldsToMask() []string {
 		"creditCard",
 		"authorization",
 		"authorizationHeader",
+		"cookie",
+		"set-cookie",
 	}
 }
 
@@ -171,8 +417,7 @@ func generateFieldsToMask(defaultFields, additionalFields []string) map[string]b
 	fields := append(defaultFields, additionalFields...)
 	fieldsToMask := make(map[string]bool)
 	for _, field := range fields {
-		field = strings.TrimSpace(field)
-		if field != "" {
+		if field = canonicalFieldName(field); field != "" {
 			fieldsToMask[field] = true
 		}
 	}
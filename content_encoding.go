@@ -0,0 +1,117 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Define the default limit on how much larger a decompressed body may be
+// than its compressed form
+const defaultMaxDecompressionRatio = 100
+
+// ErrUnsupportedContentEncoding is returned for bodies compressed with an
+// encoding that has no registered decoder
+var ErrUnsupportedContentEncoding = errors.New("unsupported content encoding")
+
+// ContentDecoder wraps a stream compressed with a given Content-Encoding in
+// a reader returning the decompressed bytes
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	contentDecodersMu sync.RWMutex
+	contentDecoders   = map[string]ContentDecoder{
+		"gzip":    newGzipDecoder,
+		"x-gzip":  newGzipDecoder,
+		"deflate": newDeflateDecoder,
+	}
+)
+
+// RegisterContentDecoder registers a decoder for a Content-Encoding such as
+// "br" or "zstd", so captured bodies can be decompressed before masking
+func RegisterContentDecoder(encoding string, decoder ContentDecoder) {
+	contentDecodersMu.Lock()
+	defer contentDecodersMu.Unlock()
+	contentDecoders[strings.ToLower(encoding)] = decoder
+}
+
+func newGzipDecoder(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// newDeflateDecoder accepts both zlib-wrapped streams, as the HTTP spec
+// requires, and the raw deflate streams some clients send instead
+func newDeflateDecoder(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// isContentEncoded reports whether a Content-Encoding header value means the
+// body needs decoding
+func isContentEncoded(contentEncoding string) bool {
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding != "" && !strings.EqualFold(encoding, "identity") {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeContent undoes every encoding listed in a Content-Encoding header
+// value, last applied first. Bodies expanding beyond ratio times their size
+// or beyond limit bytes are cut off there, which is reported so they can be
+// previewed. A partial body, cut off at the capture limit, decodes to as
+// much as its bytes allow.
+func decodeContent(contentEncoding string, body []byte, ratio, limit int, partial bool) ([]byte, bool, error) {
+	maxSize := int64(len(body)) * int64(ratio)
+	if ratio <= 0 || maxSize > int64(limit) {
+		maxSize = int64(limit)
+	}
+
+	truncated := false
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		contentDecodersMu.RLock()
+		decoder, ok := contentDecoders[encoding]
+		contentDecodersMu.RUnlock()
+		if !ok {
+			return nil, false, fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, encoding)
+		}
+
+		reader, err := decoder(bytes.NewReader(body))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode %s body: %w", encoding, err)
+		}
+		decoded, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+		reader.Close()
+		if (partial || truncated) && errors.Is(err, io.ErrUnexpectedEOF) {
+			err = nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode %s body: %w", encoding, err)
+		}
+		if int64(len(decoded)) > maxSize {
+			decoded = decoded[:maxSize]
+			truncated = true
+		}
+		body = decoded
+	}
+	return body, truncated, nil
+}
@@ -0,0 +1,238 @@
+package treblle
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecodeContent(t *testing.T) {
+	plain := []byte(`{"password":"secret"}`)
+
+	var zlibBuf bytes.Buffer
+	zw := zlib.NewWriter(&zlibBuf)
+	zw.Write(plain)
+	zw.Close()
+
+	var flateBuf bytes.Buffer
+	fw, _ := flate.NewWriter(&flateBuf, flate.DefaultCompression)
+	fw.Write(plain)
+	fw.Close()
+
+	testCases := map[string]struct {
+		encoding string
+		body     []byte
+	}{
+		"gzip":         {"gzip", gzipBytes(t, plain)},
+		"x-gzip":       {"x-gzip", gzipBytes(t, plain)},
+		"upper-case":   {"GZIP", gzipBytes(t, plain)},
+		"deflate-zlib": {"deflate", zlibBuf.Bytes()},
+		"deflate-raw":  {"deflate", flateBuf.Bytes()},
+		"identity":     {"identity, gzip", gzipBytes(t, plain)},
+		"stacked":      {"gzip, gzip", gzipBytes(t, gzipBytes(t, plain))},
+	}
+
+	for tn, tc := range testCases {
+		decoded, truncated, err := decodeContent(tc.encoding, tc.body, defaultMaxDecompressionRatio, maxResponseSize, false)
+		require.NoError(t, err, tn)
+		assert.Equal(t, plain, decoded, tn)
+		assert.False(t, truncated, tn)
+	}
+}
+
+func TestDecodeContentErrors(t *testing.T) {
+	_, _, err := decodeContent("br", []byte("data"), defaultMaxDecompressionRatio, maxResponseSize, false)
+	assert.ErrorIs(t, err, ErrUnsupportedContentEncoding)
+
+	_, _, err = decodeContent("gzip", []byte("not gzip"), defaultMaxDecompressionRatio, maxResponseSize, false)
+	assert.Error(t, err)
+
+}
+
+func TestDecodeContentCutOffAtRatio(t *testing.T) {
+	// A small body expanding far beyond the ratio is cut off there
+	bomb := gzipBytes(t, bytes.Repeat([]byte{'a'}, 1<<20))
+	decoded, truncated, err := decodeContent("gzip", bomb, defaultMaxDecompressionRatio, maxResponseSize, false)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Len(t, decoded, len(bomb)*defaultMaxDecompressionRatio)
+}
+
+func TestDecodeContentCutOffAtLimit(t *testing.T) {
+	decoded, truncated, err := decodeContent("gzip", gzipBytes(t, []byte(strings.Repeat("ab", 100))), 1000, 100, false)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, strings.Repeat("ab", 50), string(decoded))
+
+	// Stacked encodings too
+	stacked := gzipBytes(t, gzipBytes(t, []byte(strings.Repeat("ab", 100))))
+	_, truncated, err = decodeContent("gzip, gzip", stacked, 1000, 100, false)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+}
+
+func TestRegisterContentDecoder(t *testing.T) {
+	RegisterContentDecoder("X-Upper", func(r io.Reader) (io.ReadCloser, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(bytes.ToUpper(data))), nil
+	})
+	defer func() {
+		contentDecodersMu.Lock()
+		delete(contentDecoders, "x-upper")
+		contentDecodersMu.Unlock()
+	}()
+
+	decoded, _, err := decodeContent("x-upper", []byte("hello"), defaultMaxDecompressionRatio, maxResponseSize, false)
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", string(decoded))
+}
+
+func TestRequestBodyContentEncoding(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+
+	header := http.Header{
+		"Content-Type":     {"application/json"},
+		"Content-Encoding": {"gzip"},
+	}
+	compressed := gzipBytes(t, []byte(`{"user":"bob","password":"secret"}`))
+
+	body := newRequestBody(io.NopCloser(bytes.NewReader(compressed)), 1024)
+	io.ReadAll(body)
+	errorProvider := NewErrorProvider()
+	masked, size, truncated := body.info(header, -1, errorProvider)
+	assert.Empty(t, errorProvider.GetErrors())
+	assert.JSONEq(t, `{"user":"bob","password":"*********"}`, string(masked))
+	assert.Equal(t, len(compressed), size)
+	assert.False(t, truncated)
+
+	header.Set("Content-Encoding", "br")
+	body = newRequestBody(io.NopCloser(bytes.NewReader(compressed)), 1024)
+	io.ReadAll(body)
+	masked, _, _ = body.info(header, -1, errorProvider)
+	assert.Equal(t, `{}`, string(masked))
+	require.Len(t, errorProvider.GetErrors(), 1)
+	assert.Contains(t, errorProvider.GetErrors()[0].Message, "unsupported content encoding")
+}
+
+func TestCompressedBodiesBeyondCaptureLimitArePreviewed(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}, MaxDecompressionRatio: 1000})
+	defer Configure(Configuration{})
+
+	items := make([]string, 200)
+	for i := range items {
+		items[i] = `{"user":"bob","password":"secret"}`
+	}
+	compressed := gzipBytes(t, []byte("["+strings.Join(items, ",")+"]"))
+	require.Less(t, len(compressed), 1024)
+
+	w := newResponseWriter(httptest.NewRecorder(), 1024)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Write(compressed)
+	errorProvider := NewErrorProvider()
+	response := getResponseInfo(w, time.Now(), errorProvider)
+	assert.Empty(t, errorProvider.GetErrors())
+	assert.True(t, response.Truncated)
+	assert.Equal(t, len(compressed), response.Size)
+	var preview []map[string]string
+	require.NoError(t, json.Unmarshal(response.Body, &preview))
+	assert.NotEmpty(t, preview)
+	assert.Equal(t, map[string]string{"user": "bob", "password": "*********"}, preview[0])
+
+	header := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}
+	body := newRequestBody(io.NopCloser(bytes.NewReader(compressed)), 1024)
+	io.ReadAll(body)
+	masked, size, truncated := body.info(header, -1, errorProvider)
+	assert.Empty(t, errorProvider.GetErrors())
+	assert.True(t, truncated)
+	assert.Equal(t, len(compressed), size)
+	require.NoError(t, json.Unmarshal(masked, &preview))
+	assert.NotEmpty(t, preview)
+}
+
+func TestHighlyCompressedBodiesArePreviewed(t *testing.T) {
+	Configure(Configuration{})
+
+	items := make([]string, 2000)
+	for i := range items {
+		items[i] = `{"id":1}`
+	}
+	compressed := gzipBytes(t, []byte("["+strings.Join(items, ",")+"]"))
+
+	w := newResponseWriter(httptest.NewRecorder(), maxResponseSize)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Write(compressed)
+	errorProvider := NewErrorProvider()
+	response := getResponseInfo(w, time.Now(), errorProvider)
+
+	// Expanding beyond the ratio is no error, the body is previewed
+	assert.Empty(t, errorProvider.GetErrors())
+	assert.True(t, response.Truncated)
+	var preview []map[string]int
+	require.NoError(t, json.Unmarshal(response.Body, &preview))
+	assert.NotEmpty(t, preview)
+}
+
+func TestMiddlewareCompressedResponse(t *testing.T) {
+	received := make(chan MetaData, 1)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	Configure(Configuration{
+		SDK_TOKEN:           "test-sdk-token",
+		API_KEY:             "test-api-key",
+		Endpoint:            treblleServer.URL,
+		DefaultFieldsToMask: []string{"password"},
+	})
+
+	compressed := gzipBytes(t, []byte(`{"password":"secret"}`))
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// The client still receives the compressed bytes
+	assert.Equal(t, compressed, w.Body.Bytes())
+
+	select {
+	case meta := <-received:
+		assert.Empty(t, meta.Data.Response.Errors)
+		assert.JSONEq(t, `{"password":"*********"}`, string(meta.Data.Response.Body))
+		assert.Equal(t, len(compressed), meta.Data.Response.Size)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Treblle payload")
+	}
+}
@@ -0,0 +1,108 @@
+package treblle
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CookieMaskRule sets how the values of matching cookies are masked.
+// Cookies no rule matches have their values masked fully.
+type CookieMaskRule struct {
+	Name     string       // Case-insensitive cookie name glob, e.g. "_ga*"
+	Strategy MaskStrategy // How the value is masked, MaskKeep reports it as is (default: full)
+}
+
+// SetCookieInfo describes a cookie set by a response, so cookie hygiene can
+// be audited without reporting its value
+type SetCookieInfo struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	MaxAge   int    `json:"max_age,omitempty"`
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"http_only"`
+	SameSite string `json:"same_site,omitempty"`
+}
+
+// isCookieHeader reports whether a header is reported cookie by cookie
+func isCookieHeader(key string) bool {
+	return strings.EqualFold(key, "Cookie") || strings.EqualFold(key, "Set-Cookie")
+}
+
+// maskCookieHeader reports a Cookie header as an object of masked cookie
+// values and a Set-Cookie header as a list of cookies with their attributes
+func maskCookieHeader(key string, values []string) (interface{}, bool) {
+	if strings.EqualFold(key, "Cookie") {
+		cookies := (&http.Request{Header: http.Header{"Cookie": values}}).Cookies()
+		reported := make(map[string]interface{}, len(cookies))
+		for _, cookie := range cookies {
+			if value, ok := maskCookieValue(cookie.Name, cookie.Value); ok {
+				addFormValue(reported, cookie.Name, value)
+			}
+		}
+		return reported, len(reported) > 0
+	}
+
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": values}}).Cookies()
+	reported := make([]SetCookieInfo, 0, len(cookies))
+	for _, cookie := range cookies {
+		value, ok := maskCookieValue(cookie.Name, cookie.Value)
+		if !ok {
+			continue
+		}
+		info := SetCookieInfo{
+			Name:     cookie.Name,
+			Value:    value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			MaxAge:   cookie.MaxAge,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			SameSite: sameSiteName(cookie.SameSite),
+		}
+		if !cookie.Expires.IsZero() {
+			info.Expires = cookie.Expires.UTC().Format(time.RFC3339)
+		}
+		reported = append(reported, info)
+	}
+	return reported, len(reported) > 0
+}
+
+// maskCookieValue masks a cookie value with the first matching rule. It
+// returns false when the cookie is dropped.
+func maskCookieValue(name, value string) (string, bool) {
+	strategy := MaskFull
+	for _, rule := range Config.CookieMaskRules {
+		if matchAnyGlob([]string{rule.Name}, name) {
+			if rule.Strategy != "" {
+				strategy = rule.Strategy
+			}
+			break
+		}
+	}
+
+	switch {
+	case strategy == MaskDrop:
+		return "", false
+	case value == "":
+		return value, true
+	}
+	masked, _ := scalarText(Config.masking.apply(value, strategy))
+	return masked, true
+}
+
+func sameSiteName(mode http.SameSite) string {
+	switch mode {
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteNoneMode:
+		return "None"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,77 @@
+package treblle
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskCookieHeader(t *testing.T) {
+	Configure(Configuration{
+		CookieMaskRules: []CookieMaskRule{
+			{Name: "theme", Strategy: MaskKeep},
+			{Name: "_ga*", Strategy: MaskDrop},
+			{Name: "CART", Strategy: MaskLast4},
+		},
+	})
+	defer Configure(Configuration{})
+
+	cookies, ok := maskCookieHeader("Cookie", []string{"session=abc123; theme=dark; _ga=GA1.2.3; cart=items-1234", "session=other"})
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"session": []interface{}{"*********", "*********"},
+		"theme":   "dark",
+		"cart":    "******1234",
+	}, cookies)
+
+	_, ok = maskCookieHeader("Cookie", []string{"_ga=GA1.2.3"})
+	assert.False(t, ok)
+}
+
+func TestMaskSetCookieHeader(t *testing.T) {
+	Configure(Configuration{})
+
+	expires := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+	header := http.Header{}
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     "session",
+		Value:    "abc123",
+		Path:     "/",
+		Domain:   "example.com",
+		Expires:  expires,
+		MaxAge:   3600,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}).String())
+	header.Add("Set-Cookie", "tracking=xyz")
+
+	reported := maskHeaders(header)
+	assert.Equal(t, []SetCookieInfo{
+		{
+			Name:     "session",
+			Value:    "*********",
+			Path:     "/",
+			Domain:   "example.com",
+			Expires:  "2030-01-02T03:04:05Z",
+			MaxAge:   3600,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: "Strict",
+		},
+		{Name: "tracking", Value: "*********"},
+	}, reported["Set-Cookie"])
+}
+
+func TestCookiesMaskedWithoutMaskedFieldNames(t *testing.T) {
+	// Cookie values stay masked even when the header is not a masked field
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+	defer Configure(Configuration{})
+
+	header := http.Header{}
+	header.Set("Cookie", "session=abc123")
+	assert.Equal(t, map[string]interface{}{"session": "*********"}, maskHeaders(header)["Cookie"])
+}
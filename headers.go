@@ -0,0 +1,69 @@
+package treblle
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// getMaskedHeaders captures request or response headers for Treblle.
+// Headers with a single value are reported as strings and repeated headers
+// as arrays, masked like any other field. Headers left out by the configured
+// allow and deny lists are not reported at all.
+func getMaskedHeaders(header http.Header) (json.RawMessage, error) {
+	return json.Marshal(maskHeaders(header))
+}
+
+func maskHeaders(header http.Header) map[string]interface{} {
+	headers := make(map[string]interface{}, len(header))
+	for key, values := range header {
+		if len(values) == 0 || !isHeaderReported(key) {
+			continue
+		}
+
+		// Cookies are masked one by one
+		if isCookieHeader(key) {
+			if cookies, ok := maskCookieHeader(key, values); ok {
+				headers[key] = cookies
+			}
+			continue
+		}
+
+		reported := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			if masked, ok := maskNamedValue(key, value); ok {
+				reported = append(reported, masked)
+			}
+		}
+
+		switch len(reported) {
+		case 0:
+			// Every value was dropped by a mask rule
+		case 1:
+			headers[key] = reported[0]
+		default:
+			headers[key] = reported
+		}
+	}
+	return headers
+}
+
+// isHeaderReported applies the header allow and deny lists
+func isHeaderReported(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	if len(Config.headerAllowList) > 0 && !Config.headerAllowList[key] {
+		return false
+	}
+	return !Config.headerDenyList[key]
+}
+
+// newHeaderSet builds a lookup of canonical header names
+func newHeaderSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
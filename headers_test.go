@@ -0,0 +1,85 @@
+package treblle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskHeaders(t *testing.T) {
+	Configure(Configuration{})
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer abc123")
+	header.Set("Cookie", "session=abc")
+	header.Set("X-Api-Key", "key-123")
+	header.Set("Content-Type", "application/json")
+	header.Add("Accept", "application/json")
+	header.Add("Accept", "text/plain")
+	header["Empty"] = []string{}
+
+	assert.Equal(t, map[string]interface{}{
+		"Authorization": "Bearer *********",
+		"Cookie":        map[string]interface{}{"session": "*********"},
+		"X-Api-Key":     "*********",
+		"Content-Type":  "application/json",
+		"Accept":        []interface{}{"application/json", "text/plain"},
+	}, maskHeaders(header))
+}
+
+func TestHeaderAllowAndDenyLists(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("User-Agent", "test")
+	header.Set("X-Internal-Trace", "abc")
+
+	Configure(Configuration{HeaderDenyList: []string{"x-internal-trace"}})
+	assert.Equal(t, map[string]interface{}{
+		"Content-Type": "application/json",
+		"User-Agent":   "test",
+	}, maskHeaders(header))
+
+	Configure(Configuration{
+		HeaderAllowList: []string{"content-type", "X-Internal-Trace"},
+		HeaderDenyList:  []string{"X-Internal-Trace"},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"Content-Type": "application/json",
+	}, maskHeaders(header))
+
+	Configure(Configuration{})
+	assert.Len(t, maskHeaders(header), 3)
+}
+
+func TestRequestAndResponseHeadersMasked(t *testing.T) {
+	Configure(Configuration{})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	r.Header.Add("X-Forwarded-For", "10.0.0.1")
+	r.Header.Add("X-Forwarded-For", "10.0.0.2")
+
+	requestInfo, err := getRequestInfo(r, time.Now(), NewErrorProvider())
+	require.NoError(t, err)
+
+	var requestHeaders map[string]interface{}
+	require.NoError(t, json.Unmarshal(requestInfo.Headers, &requestHeaders))
+	assert.Equal(t, "Basic *********", requestHeaders["Authorization"])
+	assert.Equal(t, []interface{}{"10.0.0.1", "10.0.0.2"}, requestHeaders["X-Forwarded-For"])
+
+	w := newResponseWriter(httptest.NewRecorder(), maxResponseSize)
+	w.Header().Add("Set-Cookie", "session=abc")
+	w.Header().Add("Set-Cookie", "theme=dark")
+	w.WriteHeader(http.StatusNoContent)
+
+	responseInfo := getResponseInfo(w, time.Now(), NewErrorProvider())
+	var responseHeaders map[string]interface{}
+	require.NoError(t, json.Unmarshal(responseInfo.Headers, &responseHeaders))
+	assert.Len(t, responseHeaders["Set-Cookie"], 2)
+	assert.NotContains(t, string(responseInfo.Headers), "abc")
+}
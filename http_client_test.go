@@ -0,0 +1,167 @@
+package treblle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// writePEM writes a PEM block to a file in dir and returns its path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+func TestConfiguredHTTPClientAndTransport(t *testing.T) {
+	defer Configure(Configuration{})
+
+	var calls int
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+
+	Configure(Configuration{HTTPTransport: transport})
+	require.NoError(t, (&HTTPSender{Endpoint: "http://treblle.invalid"}).Send(context.Background(), MetaData{}))
+	assert.Equal(t, 1, calls)
+
+	client := &http.Client{Transport: transport}
+	Configure(Configuration{HTTPClient: client, HTTPTransport: http.DefaultTransport})
+	assert.Same(t, client, Config.httpClient)
+	require.NoError(t, (&HTTPSender{Endpoint: "http://treblle.invalid"}).Send(context.Background(), MetaData{}))
+	assert.Equal(t, 2, calls)
+
+	// Without a client or transport one is built from the options
+	Configure(Configuration{})
+	built := Config.httpClient
+	require.NotNil(t, built)
+	assert.NotSame(t, defaultHTTPClient, built)
+}
+
+func TestHTTPClientOptions(t *testing.T) {
+	client, err := newHTTPClient(Configuration{
+		DialTimeout:           time.Second,
+		TLSHandshakeTimeout:   2 * time.Second,
+		ResponseHeaderTimeout: 3 * time.Second,
+		MaxIdleConns:          7,
+		MaxIdleConnsPerHost:   5,
+	})
+	require.NoError(t, err)
+
+	transport := client.Transport.(*http.Transport)
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 3*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, 7, transport.MaxIdleConns)
+	assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	assert.Zero(t, client.Timeout)
+
+	_, err = newHTTPClient(Configuration{ProxyURL: "://bad"})
+	assert.Error(t, err)
+	_, err = newHTTPClient(Configuration{CACertFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+	_, err = newHTTPClient(Configuration{ClientCertFile: "cert.pem"})
+	assert.Error(t, err)
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	client, err := newHTTPClient(Configuration{ProxyURL: proxy.URL})
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://ingest.treblle.invalid/payload")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://ingest.treblle.invalid/payload", proxied)
+}
+
+func TestHTTPClientCustomCAAndClientCertificate(t *testing.T) {
+	var clientCertificates int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertificates = len(r.TLS.PeerCertificates)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	certificate := server.TLS.Certificates[0]
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", certificate.Certificate[0])
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	require.NoError(t, err)
+	keyFile := writePEM(t, dir, "key.pem", "PRIVATE KEY", key)
+
+	// Without the CA the server is not trusted
+	client, err := newHTTPClient(Configuration{})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+
+	client, err = newHTTPClient(Configuration{
+		CACertFile:     caFile,
+		ClientCertFile: caFile,
+		ClientKeyFile:  keyFile,
+	})
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, clientCertificates)
+}
+
+func TestHTTPClientLeavesTheConfiguredCertPoolAlone(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.TLS.Certificates[0].Certificate[0])
+
+	pool := x509.NewCertPool()
+	_, err := newHTTPClient(Configuration{TLSConfig: &tls.Config{RootCAs: pool}, CACertFile: caFile})
+	require.NoError(t, err)
+	assert.True(t, pool.Equal(x509.NewCertPool()))
+}
+
+func TestConfigureClosesIdleConnectionsOfTheReplacedTransport(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	Configure(Configuration{MaxIdleConns: 1})
+	defer Configure(Configuration{})
+	resp, err := Config.httpClient.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	Configure(Configuration{MaxIdleConns: 1})
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the idle connection of the replaced transport was not closed")
+	}
+}
@@ -0,0 +1,261 @@
+package treblle
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaskStrategy decides how a masked value is replaced
+type MaskStrategy string
+
+const (
+	MaskFull  MaskStrategy = "full"  // Replace the value with asterisks
+	MaskLast4 MaskStrategy = "last4" // Keep only the last four characters
+	MaskHash  MaskStrategy = "hash"  // Replace the value with a salted HMAC token, so equal values can still be correlated
+	MaskDrop  MaskStrategy = "drop"  // Leave the key out entirely
+	MaskKeep  MaskStrategy = "keep"  // Report the value as is, overriding later rules and the masked field names
+)
+
+// MaskDetector recognises sensitive values whatever key they are stored under
+type MaskDetector string
+
+const (
+	DetectCardNumber MaskDetector = "card_number" // Luhn-valid payment card numbers
+	DetectJWT        MaskDetector = "jwt"         // JSON Web Tokens, with or without a Bearer prefix
+	DetectEmail      MaskDetector = "email"       // Email addresses
+	DetectIBAN       MaskDetector = "iban"        // IBANs with a valid checksum
+	DetectAWSKey     MaskDetector = "aws_key"     // AWS access key IDs
+)
+
+// MaskRule masks the values it selects with its strategy. A rule selects a
+// value when every condition it sets matches; rules without any condition
+// are ignored. Rules are checked in order and apply before the masked field
+// names, to bodies, query parameters and headers alike.
+type MaskRule struct {
+	Path     string       // Dot-separated path from the root, "*" matching any key or array index and "**" any depth, e.g. "user.payment.*.number"
+	KeyRegex string       // Regular expression matched against key names at any depth, e.g. "(?i)^x-.*-token$"
+	Detector MaskDetector // Detector the value must match, e.g. DetectCardNumber
+	Strategy MaskStrategy // How selected values are masked (default: full)
+}
+
+var (
+	jwtPattern    = regexp.MustCompile(`^(?i:bearer\s+)?eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*$`)
+	emailPattern  = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	ibanPattern   = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	awsKeyPattern = regexp.MustCompile(`^(AKIA|ASIA)[A-Z0-9]{16}$`)
+)
+
+var maskDetectors = map[MaskDetector]func(string) bool{
+	DetectCardNumber: isCardNumber,
+	DetectJWT:        jwtPattern.MatchString,
+	DetectEmail:      emailPattern.MatchString,
+	DetectIBAN:       isIBAN,
+	DetectAWSKey:     awsKeyPattern.MatchString,
+}
+
+type compiledMaskRule struct {
+	path     []string
+	keyRegex *regexp.Regexp
+	detector func(string) bool
+	strategy MaskStrategy
+}
+
+// maskingEngine applies the configured mask rules. A nil engine has no rules.
+type maskingEngine struct {
+	rules []compiledMaskRule
+	salt  []byte
+}
+
+// newMaskingEngine compiles rules, skipping those that cannot be compiled.
+// Without a salt, hash tokens are only stable for the life of the process.
+func newMaskingEngine(rules []MaskRule, salt string) *maskingEngine {
+	engine := &maskingEngine{salt: []byte(salt)}
+	if len(engine.salt) == 0 {
+		engine.salt = make([]byte, 32)
+		_, _ = rand.Read(engine.salt)
+	}
+
+	for _, rule := range rules {
+		compiled := compiledMaskRule{strategy: rule.Strategy}
+		if compiled.strategy == "" {
+			compiled.strategy = MaskFull
+		}
+		if rule.Path != "" {
+			compiled.path = splitMaskPath(rule.Path)
+		}
+		if rule.KeyRegex != "" {
+			re, err := regexp.Compile(rule.KeyRegex)
+			if err != nil {
+				if Config.Debug {
+					fmt.Printf("Ignoring mask rule with invalid key regex %q: %v\n", rule.KeyRegex, err)
+				}
+				continue
+			}
+			compiled.keyRegex = re
+		}
+		if rule.Detector != "" {
+			detector, ok := maskDetectors[rule.Detector]
+			if !ok {
+				if Config.Debug {
+					fmt.Printf("Ignoring mask rule with unknown detector %q\n", rule.Detector)
+				}
+				continue
+			}
+			compiled.detector = detector
+		}
+		if compiled.path == nil && compiled.keyRegex == nil && compiled.detector == nil {
+			continue
+		}
+		engine.rules = append(engine.rules, compiled)
+	}
+	return engine
+}
+
+// splitMaskPath splits "a.b[*].c" into its segments, lower-cased since
+// paths match case-insensitively
+func splitMaskPath(path string) []string {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(strings.ToLower(path))
+	return strings.Split(strings.Trim(path, "."), ".")
+}
+
+// match returns the strategy of the first rule selecting value, stored
+// under key at path
+func (e *maskingEngine) match(path []string, key string, value interface{}) (MaskStrategy, bool) {
+	if e == nil || len(e.rules) == 0 {
+		return "", false
+	}
+
+	var lowerPath []string
+	for _, rule := range e.rules {
+		if rule.path != nil {
+			if lowerPath == nil {
+				lowerPath = make([]string, len(path))
+				for i, segment := range path {
+					lowerPath[i] = strings.ToLower(segment)
+				}
+			}
+			if !matchSegments(rule.path, lowerPath) {
+				continue
+			}
+		}
+		if rule.keyRegex != nil && (key == "" || !rule.keyRegex.MatchString(key)) {
+			continue
+		}
+		if rule.detector != nil {
+			text, ok := scalarText(value)
+			if !ok || !rule.detector(strings.TrimSpace(text)) {
+				continue
+			}
+		}
+		return rule.strategy, true
+	}
+	return "", false
+}
+
+// apply masks value with strategy. MaskDrop is left to the caller, which
+// knows how to remove the value.
+func (e *maskingEngine) apply(value interface{}, strategy MaskStrategy) interface{} {
+	if strategy == MaskKeep {
+		return value
+	}
+
+	text, ok := scalarText(value)
+	if !ok {
+		encoded, _ := json.Marshal(value)
+		text = string(encoded)
+	}
+
+	switch strategy {
+	case MaskLast4:
+		runes := []rune(text)
+		if len(runes) <= 4 {
+			return strings.Repeat("*", 9)
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	case MaskHash:
+		var salt []byte
+		if e != nil {
+			salt = e.salt
+		}
+		mac := hmac.New(sha256.New, salt)
+		mac.Write([]byte(text))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:32]
+	default:
+		return strings.Repeat("*", 9)
+	}
+}
+
+// scalarText returns strings and numbers as text
+func scalarText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// isCardNumber reports whether s holds 13 to 19 digits, optionally grouped
+// with spaces or dashes, passing the Luhn check
+func isCardNumber(s string) bool {
+	digits := make([]int, 0, 19)
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, int(c-'0'))
+		case c == ' ' || c == '-':
+		default:
+			return false
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	for i := range digits {
+		digit := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// isIBAN reports whether s is an IBAN, optionally grouped with spaces, with
+// a valid mod-97 checksum
+func isIBAN(s string) bool {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	if !ibanPattern.MatchString(s) {
+		return false
+	}
+
+	// Move the country code and check digits to the end and turn letters
+	// into numbers, A being 10
+	var numeric strings.Builder
+	for _, c := range s[4:] + s[:4] {
+		if c >= 'A' && c <= 'Z' {
+			numeric.WriteString(strconv.Itoa(int(c-'A') + 10))
+		} else {
+			numeric.WriteRune(c)
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
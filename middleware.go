@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"net/http/httptest"
 	"time"
 )
 
@@ -17,9 +16,27 @@ func Middleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Apply the first matching rule. Rules on status codes can only be
+		// decided once the handler has written the response.
+		action, decided := evaluateRules(Config.Rules, r, 0)
+		if decided && action == RuleSkip {
+			next.ServeHTTP(w, r)
+			return
+		}
+		captureBodies := !decided || action != RuleMetadata
+
+		// Time spent outside the handler is the overhead of the SDK.
+		// Requests whose handler panicked are left out.
+		began := time.Now()
+		handlerTime := time.Duration(-1)
+		defer func() {
+			if handlerTime >= 0 {
+				telemetry.overhead.observe(time.Since(began) - handlerTime)
+			}
+		}()
+
 		// Create error provider for this request
 		errorProvider := NewErrorProvider()
-		defer errorProvider.Clear()
 
 		// Recover from panics
 		defer func() {
@@ -39,8 +56,16 @@ func Middleware(next http.Handler) http.Handler {
 		startTime := time.Now()
 		r = tracker.StoreStartTime(r)
 
-		// Get request info before processing
-		requestInfo, errReqInfo := getRequestInfo(r, startTime, errorProvider)
+		// Capture the request body as the handler reads it
+		var body *requestBody
+		if captureBodies && r.Body != nil && r.Body != http.NoBody {
+			body = captureRequestBody(r)
+			defer body.release()
+		}
+
+		// Get request info before processing, the body follows once the
+		// handler has read it
+		requestInfo, errReqInfo := getRequestInfoWithoutBody(r, startTime, errorProvider)
 		if errReqInfo != nil && !errors.Is(errReqInfo, ErrNotJson) {
 			errorProvider.AddError(errReqInfo, ValidationError, "request_processing")
 		}
@@ -66,22 +91,69 @@ func Middleware(next http.Handler) http.Handler {
 		serverInfo := Config.serverInfo
 		serverInfo.Protocol = DetectProtocol(r)
 
-		// Intercept the response so it can be copied
-		rec := httptest.NewRecorder()
-		next.ServeHTTP(rec, r)
+		// Write the response through to the client while keeping a copy of
+		// the body for Treblle
+		responseLimit := Config.MaxResponseCaptureSize
+		if !captureBodies {
+			responseLimit = 0
+		}
+		rw := newResponseWriter(w, responseLimit)
+
+		// Upgraded WebSocket connections are reported once they are closed
+		if isWebSocketUpgrade(r) {
+			rw.onWebSocketClose = func(session *WebSocketSessionInfo) {
+				if !decided {
+					if action, _ := evaluateRules(Config.Rules, r, http.StatusSwitchingProtocols); action == RuleSkip {
+						return
+					}
+				}
+				// The session length says nothing about the handshake latency
+				rate, keep := applySampling(r, http.StatusSwitchingProtocols, 0, errorProvider)
+				if !keep {
+					return
+				}
+				requestInfo.SampleRate = rate
+				responseInfo := getWebSocketResponseInfo(rw, session, startTime, errorProvider)
+				submit(requestInfo, responseInfo, serverInfo, errorProvider)
+			}
+		}
+
+		handlerStart := time.Now()
+		next.ServeHTTP(rw, r)
+		handlerTime = time.Since(handlerStart)
+
+		// The handler took over the connection. WebSocket sessions are
+		// reported on close, anything else has no HTTP response to report.
+		if rw.hijacked {
+			return
+		}
 
-		// Copy everything from response recorder to response writer
-		for k, v := range rec.Header() {
-			w.Header()[k] = v
+		if !decided {
+			if action, _ = evaluateRules(Config.Rules, r, rw.Status()); action == RuleSkip {
+				return
+			}
 		}
-		w.WriteHeader(rec.Code)
 
-		// Write response body
-		_, err := w.Write(rec.Body.Bytes())
-		if err != nil {
-			errorProvider.AddError(err, ServerError, "response_writing")
+		// Leave out requests that are not part of the sample before their
+		// bodies are decoded and masked. Errors raised from here on do not
+		// keep a request.
+		rate, keep := applySampling(r, rw.Status(), time.Since(startTime), errorProvider)
+		if !keep {
 			return
 		}
+		requestInfo.SampleRate = rate
+
+		// Add what the handler read of the body. The rest is never read
+		// here, so early rejections do not wait for the upload to finish.
+		if body != nil {
+			requestInfo.Body, requestInfo.Size, requestInfo.Truncated = body.info(r.Header, r.ContentLength, errorProvider)
+		}
+
+		// An event stream ends either because the client went away or
+		// because the handler returned
+		if rw.sse != nil {
+			rw.sse.close(r.Context().Err() != nil)
+		}
 
 		// Send to Treblle if:
 		// 1. The request was valid JSON (or had no body)
@@ -89,39 +161,52 @@ func Middleware(next http.Handler) http.Handler {
 		// 2. The response is JSON (regardless of status code)
 		// OR
 		// 3. The response is not JSON (we'll still track it)
-		responseInfo := getResponseInfo(rec, startTime, errorProvider)
+		responseInfo := getResponseInfo(rw, startTime, errorProvider)
 
 		// Add all collected errors to the response
 		responseInfo.Errors = errorProvider.GetErrors()
 
-		if Config.AsyncProcessingEnabled {
-			// Process asynchronously with controlled concurrency
-			GetAsyncProcessor().Process(requestInfo, responseInfo, errorProvider)
-		} else {
-			// Create metadata
-			ti := MetaData{
-				ApiKey:    Config.APIKey,
-				ProjectID: Config.ProjectID,
-				Version:   Config.SDKVersion,
-				Sdk:       Config.SDKName,
-				Data: DataInfo{
-					Server:   serverInfo,
-					Language: Config.languageInfo,
-					Request:  requestInfo,
-					Response: responseInfo,
-				},
-			}
-
-			// Don't block execution while sending data to Treblle
-			go func(ti MetaData) {
-				defer func() {
-					if err := recover(); err != nil {
-						fmt.Printf("Panic recovered in goroutine: %v\n", err)
-						// Silently recover from panic
-					}
-				}()
-				sendToTreblle(ti)
-			}(ti)
+		if action == RuleMetadata {
+			dropBodies(&requestInfo, &responseInfo, r.ContentLength)
 		}
+
+		submit(requestInfo, responseInfo, serverInfo, errorProvider)
 	})
 }
+
+// submit hands the collected request and response to Treblle without
+// blocking the caller
+func submit(requestInfo RequestInfo, responseInfo ResponseInfo, serverInfo ServerInfo, errorProvider *ErrorProvider) {
+	telemetry.captured.Add(1)
+
+	if Config.AsyncProcessingEnabled {
+		// Process asynchronously with controlled concurrency
+		GetAsyncProcessor().Process(requestInfo, responseInfo, errorProvider)
+		return
+	}
+
+	// Create metadata
+	ti := MetaData{
+		ApiKey:    Config.APIKey,
+		ProjectID: Config.ProjectID,
+		Version:   Config.SDKVersion,
+		Sdk:       Config.SDKName,
+		Data: DataInfo{
+			Server:   serverInfo,
+			Language: Config.languageInfo,
+			Request:  requestInfo,
+			Response: responseInfo,
+		},
+	}
+
+	// Don't block execution while sending data to Treblle
+	go func(ti MetaData) {
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Printf("Panic recovered in goroutine: %v\n", err)
+				// Silently recover from panic
+			}
+		}()
+		sendToTreblle(ti)
+	}(ti)
+}
@@ -0,0 +1,178 @@
+package treblle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"sync"
+)
+
+// maxMultipartFieldSize bounds the bytes kept for a single non-file form field
+const maxMultipartFieldSize = 64 * 1024
+
+// multipartFileOverhead approximates the size of a reported file besides
+// its names and content type
+const multipartFileOverhead = 128
+
+// MultipartFile describes an uploaded file. Its content is never reported.
+type MultipartFile struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// multipartCapture parses a multipart/form-data body while it streams to the
+// handler. Bytes are handed over through a pipe to a parser goroutine that
+// keeps form fields and file metadata only, up to limit bytes in total.
+type multipartCapture struct {
+	pw        *io.PipeWriter
+	done      chan struct{}
+	finish    sync.Once
+	hashFiles bool
+	limit     int
+
+	fields    map[string]interface{}
+	files     map[string]interface{}
+	kept      int  // Approximate bytes of the fields and files kept
+	truncated bool // Set once entries were left out to stay within limit
+	err       error
+}
+
+// newMultipartCapture returns a capture for multipart/form-data content
+// types keeping up to limit bytes of fields and file metadata, or nil for
+// anything else
+func newMultipartCapture(contentType string, hashFiles bool, limit int) *multipartCapture {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	c := &multipartCapture{
+		pw:        pw,
+		done:      make(chan struct{}),
+		hashFiles: hashFiles,
+		limit:     limit,
+		fields:    make(map[string]interface{}),
+		files:     make(map[string]interface{}),
+	}
+	go c.parse(pr, params["boundary"])
+	return c
+}
+
+// write feeds body bytes to the parser
+func (c *multipartCapture) write(p []byte) {
+	_, _ = c.pw.Write(p)
+}
+
+// close ends the stream and waits for the parser to finish
+func (c *multipartCapture) close() {
+	c.finish.Do(func() {
+		c.pw.Close()
+		<-c.done
+	})
+}
+
+func (c *multipartCapture) parse(pr *io.PipeReader, boundary string) {
+	defer close(c.done)
+	// Keep draining after an error so the handler is never blocked
+	defer io.Copy(io.Discard, pr)
+
+	reader := multipart.NewReader(pr, boundary)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxMultipartFieldSize))
+			if err == nil {
+				_, err = io.Copy(io.Discard, part)
+			}
+			if c.keep(len(part.FormName()) + len(value)) {
+				addFormValue(c.fields, part.FormName(), string(value))
+			}
+			if err != nil {
+				c.err = err
+				return
+			}
+			continue
+		}
+
+		file := MultipartFile{
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+		}
+		var digest hash.Hash
+		var sink io.Writer = io.Discard
+		if c.hashFiles {
+			digest = sha256.New()
+			sink = digest
+		}
+		file.Size, err = io.Copy(sink, part)
+		if err == nil && digest != nil {
+			file.SHA256 = hex.EncodeToString(digest.Sum(nil))
+		}
+		if c.keep(len(part.FormName()) + len(file.Filename) + len(file.ContentType) + multipartFileOverhead) {
+			addFormValue(c.files, part.FormName(), file)
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+// keep reports whether an entry of size bytes fits within the limit,
+// counting it when it does. Once an entry is left out, later ones are too.
+func (c *multipartCapture) keep(size int) bool {
+	if c.truncated || c.kept+size > c.limit {
+		c.truncated = true
+		return false
+	}
+	c.kept += size
+	return true
+}
+
+// body returns the masked form fields merged with the file metadata
+func (c *multipartCapture) body() (json.RawMessage, error) {
+	c.close()
+
+	data := maskData(c.fields).(map[string]interface{})
+	for name, files := range c.files {
+		if existing, ok := data[name]; ok {
+			data[name] = []interface{}{existing, files}
+			continue
+		}
+		data[name] = files
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return body, c.err
+}
+
+// addFormValue stores value under name, turning repeated names into arrays
+func addFormValue(values map[string]interface{}, name string, value interface{}) {
+	switch existing := values[name].(type) {
+	case nil:
+		values[name] = value
+	case []interface{}:
+		values[name] = append(existing, value)
+	default:
+		values[name] = []interface{}{existing, value}
+	}
+}
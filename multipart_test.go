@@ -0,0 +1,155 @@
+package treblle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMultipartRequest(t *testing.T, fileContent string) *http.Request {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	require.NoError(t, writer.WriteField("username", "bob"))
+	require.NoError(t, writer.WriteField("password", "secret"))
+	require.NoError(t, writer.WriteField("tag", "a"))
+	require.NoError(t, writer.WriteField("tag", "b"))
+	file, err := writer.CreateFormFile("avatar", "me.png")
+	require.NoError(t, err)
+	file.Write([]byte(fileContent))
+	require.NoError(t, writer.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestMultipartCapture(t *testing.T) {
+	Configure(Configuration{
+		DefaultFieldsToMask: []string{"password"},
+		HashMultipartFiles:  true,
+	})
+	defer Configure(Configuration{HashMultipartFiles: false})
+
+	content := strings.Repeat("\x89PNG", 1024)
+	r := newMultipartRequest(t, content)
+	body := captureRequestBody(r)
+
+	// The handler still receives the whole upload
+	require.NoError(t, r.ParseMultipartForm(1024))
+	f, _, err := r.FormFile("avatar")
+	require.NoError(t, err)
+	received, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(received))
+
+	errorProvider := NewErrorProvider()
+	masked, size, truncated := body.info(r.Header, r.ContentLength, errorProvider)
+	assert.Empty(t, errorProvider.GetErrors())
+	assert.Equal(t, int(r.ContentLength), size)
+	assert.False(t, truncated)
+
+	sum := sha256.Sum256([]byte(content))
+	var reported map[string]interface{}
+	require.NoError(t, json.Unmarshal(masked, &reported))
+	assert.Equal(t, "bob", reported["username"])
+	assert.Equal(t, "*********", reported["password"])
+	assert.Equal(t, []interface{}{"a", "b"}, reported["tag"])
+	assert.Equal(t, map[string]interface{}{
+		"filename":     "me.png",
+		"content_type": "application/octet-stream",
+		"size":         float64(len(content)),
+		"sha256":       hex.EncodeToString(sum[:]),
+	}, reported["avatar"])
+	assert.NotContains(t, string(masked), "PNG")
+}
+
+func TestMultipartCaptureLargerThanLimit(t *testing.T) {
+	Configure(Configuration{MaxRequestCaptureSize: 512})
+	defer Configure(Configuration{MaxRequestCaptureSize: defaultMaxRequestSize})
+
+	content := strings.Repeat("x", 64*1024)
+	r := newMultipartRequest(t, content)
+	body := captureRequestBody(r)
+	defer body.release()
+
+	_, err := io.Copy(io.Discard, r.Body)
+	require.NoError(t, err)
+
+	masked, _, truncated := body.info(r.Header, r.ContentLength, NewErrorProvider())
+	assert.False(t, truncated)
+
+	var reported map[string]interface{}
+	require.NoError(t, json.Unmarshal(masked, &reported))
+	assert.Equal(t, float64(len(content)), reported["avatar"].(map[string]interface{})["size"])
+}
+
+func TestMultipartCaptureBoundedByLimit(t *testing.T) {
+	Configure(Configuration{MaxRequestCaptureSize: 4096})
+	defer Configure(Configuration{MaxRequestCaptureSize: defaultMaxRequestSize})
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, writer.WriteField("field", value))
+	}
+	require.NoError(t, writer.Close())
+	r := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	body := captureRequestBody(r)
+	defer body.release()
+	_, err := io.Copy(io.Discard, r.Body)
+	require.NoError(t, err)
+
+	masked, size, truncated := body.info(r.Header, r.ContentLength, NewErrorProvider())
+	assert.True(t, truncated)
+	assert.Equal(t, int(r.ContentLength), size)
+	assert.Less(t, len(masked), 4096+1024)
+
+	var reported map[string]interface{}
+	require.NoError(t, json.Unmarshal(masked, &reported))
+	assert.Len(t, reported["field"], 3)
+}
+
+func TestMiddlewareMultipartWithoutJSONError(t *testing.T) {
+	received := make(chan MetaData, 1)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	Configure(Configuration{
+		SDK_TOKEN: "test-sdk-token",
+		API_KEY:   "test-api-key",
+		Endpoint:  treblleServer.URL,
+	})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newMultipartRequest(t, "file"))
+
+	select {
+	case meta := <-received:
+		assert.Empty(t, meta.Data.Response.Errors)
+		assert.Contains(t, string(meta.Data.Request.Body), `"filename":"me.png"`)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Treblle payload")
+	}
+}
@@ -7,20 +7,24 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
 type RequestInfo struct {
-	Timestamp string `json:"timestamp"`
-	Ip        string `json:"ip"`
-	Url       string `json:"url"` // This will now contain the normalized route path
-	RoutePath string          `json:"route_path"` // Keep the route path for compatibility
-	UserAgent string          `json:"user_agent"`
-	Method    string          `json:"method"`
-	Headers   json.RawMessage `json:"headers"`
-	Body      json.RawMessage `json:"body"`
-	Query     json.RawMessage `json:"query"`
+	Timestamp  string          `json:"timestamp"`
+	Ip         string          `json:"ip"`
+	Url        string          `json:"url"`        // This will now contain the normalized route path
+	RoutePath  string          `json:"route_path"` // Keep the route path for compatibility
+	UserAgent  string          `json:"user_agent"`
+	Method     string          `json:"method"`
+	Headers    json.RawMessage `json:"headers"`
+	Body       json.RawMessage `json:"body"`
+	Query      json.RawMessage `json:"query"`
+	Size       int             `json:"size,omitempty"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	SampleRate float64         `json:"sample_rate,omitempty"` // Rate the request was sampled at, 1 when kept regardless of sampling
 }
 
 var ErrNotJson = errors.New("request body is not JSON")
@@ -49,6 +53,18 @@ func GetRoutePath(r *http.Request) string {
 
 // Get details about the request
 func getRequestInfo(r *http.Request, startTime time.Time, errorProvider *ErrorProvider) (RequestInfo, error) {
+	requestInfo, err := getRequestInfoWithoutBody(r, startTime, errorProvider)
+	if err != nil {
+		return requestInfo, err
+	}
+
+	requestInfo.Body, requestInfo.Size, requestInfo.Truncated = getRequestBody(r, errorProvider)
+	return requestInfo, nil
+}
+
+// getRequestInfoWithoutBody collects everything but the body, which the
+// middleware only inspects once the handler has read it
+func getRequestInfoWithoutBody(r *http.Request, startTime time.Time, errorProvider *ErrorProvider) (RequestInfo, error) {
 	// Format timestamp to match Laravel (Y-m-d H:i:s)
 	timestamp := time.Now().UTC().Format("2006-01-02 15:04:05")
 
@@ -67,78 +83,48 @@ func getRequestInfo(r *http.Request, startTime time.Time, errorProvider *ErrorPr
 	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
 		scheme = "https"
 	}
-	fullURL := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.String())
+	// with sensitive query parameters and path segments masked
+	maskedPath := getMaskedPath(r.URL.EscapedPath())
+	maskedQueryStr := getMaskedQueryString(r.URL.Query())
+	fullURL := fmt.Sprintf("%s://%s%s", scheme, r.Host, maskedPath)
+	if maskedQueryStr != "" {
+		fullURL += "?" + maskedQueryStr
+	}
 
 	// Get route path with better fallback
 	routePath := GetRoutePath(r)
 	if routePath == "" {
-		routePath = r.URL.Path
+		routePath = maskedPath
+		if unescaped, err := url.PathUnescape(maskedPath); err == nil {
+			routePath = unescaped
+		}
 	}
 
 	// Normalize the route path to ensure it works with Treblle's endpoint grouping
 	routePath = normalizeRoutePath(routePath)
 
-	// Process headers (similar to Laravel's collect()->first())
-	headers := make(map[string]interface{})
-	for key, values := range r.Header {
-		if len(values) > 0 {
-			headers[key] = values[0]
-		}
-	}
-	headerJSON, err := json.Marshal(headers)
+	// Process headers
+	headerJSON, err := getMaskedHeaders(r.Header)
 	if err != nil {
 		return RequestInfo{}, fmt.Errorf("failed to marshal headers: %w", err)
 	}
 
 	// Process query parameters
 	var queryJSON []byte
-	queryParams := r.URL.Query()
-	if len(queryParams) > 0 {
-		maskedQueryStr := getMaskedQueryString(queryParams)
+	if maskedQueryStr != "" {
 		queryJSON = []byte(fmt.Sprintf("{%q: %q}", "query", maskedQueryStr))
 	} else {
 		queryJSON = []byte("{}")
 	}
 
-	// Process body
-	var bodyJSON json.RawMessage
-	if r.Body != nil {
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			return RequestInfo{}, fmt.Errorf("failed to read body: %w", err)
-		}
-		// Restore body for downstream handlers
-		r.Body = io.NopCloser(strings.NewReader(string(body)))
-
-		if len(body) > 0 {
-			maskedBody, err := getMaskedJSON(body)
-			if err != nil {
-				if err == ErrNotJson {
-					errorProvider.AddCustomError(
-						"Request body is not valid JSON",
-						ValidationError,
-						"getRequestInfo",
-					)
-					bodyJSON = json.RawMessage("{}")
-				} else {
-					return RequestInfo{}, fmt.Errorf("failed to mask body: %w", err)
-				}
-			} else {
-				bodyJSON = maskedBody
-			}
-		}
-	}
-
-
 	return RequestInfo{
 		Timestamp: timestamp,
 		Ip:        ip,
-		Url:       fullURL, // Use endpoint URL with normalized path
+		Url:       fullURL,   // Use endpoint URL with normalized path
 		RoutePath: routePath, // Keep route path for compatibility
 		UserAgent: r.UserAgent(),
 		Method:    r.Method,
 		Headers:   headerJSON,
-		Body:      bodyJSON,
 		Query:     queryJSON,
 	}, nil
 }
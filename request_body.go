@@ -0,0 +1,224 @@
+package treblle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Define the default number of request body bytes kept for Treblle (2MB)
+const defaultMaxRequestSize = 2 * 1024 * 1024
+
+// requestBody tees a request body as the handler reads it. Only the first
+// limit bytes are kept for masking; the handler always sees the full body.
+type requestBody struct {
+	io.ReadCloser
+
+	limit    int
+	captured bytes.Buffer
+	read     int64
+	eof      bool
+
+	// pending holds bytes read ahead of the handler by prefetch, and err the
+	// error that ended the read-ahead
+	pending []byte
+	err     error
+
+	// multipart parses multipart/form-data bodies instead of keeping them
+	multipart *multipartCapture
+}
+
+func newRequestBody(body io.ReadCloser, limit int) *requestBody {
+	return &requestBody{
+		ReadCloser: body,
+		limit:      limit,
+	}
+}
+
+// captureRequestBody wraps the body of r so it is captured as it is read
+func captureRequestBody(r *http.Request) *requestBody {
+	body := newRequestBody(r.Body, Config.MaxRequestCaptureSize)
+	// Compressed multipart bodies cannot be parsed as they stream
+	if !isContentEncoded(r.Header.Get("Content-Encoding")) {
+		body.multipart = newMultipartCapture(r.Header.Get("Content-Type"), Config.HashMultipartFiles, body.limit)
+	}
+	r.Body = body
+	return body
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if len(b.pending) > 0 {
+		n := copy(p, b.pending)
+		b.pending = b.pending[n:]
+		return n, nil
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.record(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// prefetch reads just past the capture limit ahead of the handler. It is
+// used when the body has to be inspected before anyone else consumes it.
+func (b *requestBody) prefetch() {
+	buf := make([]byte, 32*1024)
+	for b.err == nil && b.read <= int64(b.limit) {
+		n, err := b.ReadCloser.Read(buf)
+		b.record(buf[:n])
+		b.pending = append(b.pending, buf[:n]...)
+		if err != nil {
+			b.err = err
+			b.eof = err == io.EOF
+		}
+	}
+}
+
+// release stops any parsing still waiting for body bytes
+func (b *requestBody) release() {
+	if b.multipart != nil {
+		b.multipart.close()
+	}
+}
+
+func (b *requestBody) record(p []byte) {
+	b.read += int64(len(p))
+	if b.multipart != nil {
+		b.multipart.write(p)
+		return
+	}
+	if room := b.limit - b.captured.Len(); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		b.captured.Write(p)
+	}
+}
+
+// size returns the real size of the body. When the handler stopped reading
+// early the declared Content-Length is trusted instead.
+func (b *requestBody) size(contentLength int64) int64 {
+	if !b.eof && contentLength > b.read {
+		return contentLength
+	}
+	return b.read
+}
+
+// getRequestBody returns the masked request body together with its real size
+// and whether it was too large to be captured in full. Bodies that were not
+// wrapped by the middleware are read ahead up to the capture limit and put
+// back so the handler still receives them.
+func getRequestBody(r *http.Request, errorProvider *ErrorProvider) (json.RawMessage, int, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, 0, false
+	}
+
+	body, ok := r.Body.(*requestBody)
+	if !ok {
+		body = captureRequestBody(r)
+		body.prefetch()
+	}
+
+	return body.info(r.Header, r.ContentLength, errorProvider)
+}
+
+// info decompresses the captured body and masks it with the codec
+// registered for its content type. It returns the masked body, or a preview
+// of it when the body was too large to be captured in full, with the real
+// body size and whether it was truncated.
+func (b *requestBody) info(header http.Header, contentLength int64, errorProvider *ErrorProvider) (json.RawMessage, int, bool) {
+	size := b.size(contentLength)
+
+	// Multipart bodies are parsed as they stream, whatever their size, and
+	// keep fields and file metadata up to the capture limit
+	if b.multipart != nil {
+		body, err := b.multipart.body()
+		if err != nil {
+			errorProvider.AddCustomError(
+				fmt.Sprintf("failed to parse multipart body: %v", err),
+				ValidationError,
+				"getRequestInfo",
+			)
+		}
+		if body == nil {
+			body = json.RawMessage("{}")
+		}
+		return body, int(size), b.multipart.truncated || (!b.eof && size > b.read)
+	}
+
+	// Bodies larger than the capture limit are reported as a preview
+	truncated := size > int64(b.captured.Len())
+	if b.captured.Len() == 0 {
+		if truncated {
+			return json.RawMessage("{}"), int(size), true
+		}
+		return nil, int(size), false
+	}
+
+	captured := b.captured.Bytes()
+	if encoding := header.Get("Content-Encoding"); isContentEncoded(encoding) {
+		decoded, cut, err := decodeContent(encoding, captured, Config.MaxDecompressionRatio, b.limit, truncated)
+		if err != nil {
+			errorProvider.AddCustomError(
+				fmt.Sprintf("failed to decode request body: %v", err),
+				ValidationError,
+				"getRequestInfo",
+			)
+			return json.RawMessage("{}"), int(size), truncated
+		}
+		// Bodies expanding beyond the limits are previewed too
+		captured, truncated = decoded, truncated || cut
+	}
+
+	// Bodies without a declared type have always been treated as JSON
+	contentType := header.Get("Content-Type")
+	var codec BodyCodec = JSONCodec{}
+	if contentType != "" {
+		var ok bool
+		if codec, ok = lookupBodyCodec(contentType); !ok {
+			if truncated {
+				captured = trimPartialRune(captured)
+			}
+			return getUndecodedBody(contentType, captured), int(size), truncated
+		}
+	}
+
+	if truncated {
+		preview, ok := getBodyPreview(codec, captured)
+		if !ok {
+			preview = json.RawMessage("{}")
+		}
+		return preview, int(size), true
+	}
+
+	maskedBody, err := getMaskedBody(codec, captured)
+	if err != nil {
+		message := "Request body is not valid JSON"
+		if _, isJSON := codec.(JSONCodec); !isJSON {
+			message = fmt.Sprintf("Request body could not be decoded as %s: %v", contentType, err)
+		}
+		errorProvider.AddCustomError(message, ValidationError, "getRequestInfo")
+		return json.RawMessage("{}"), int(size), false
+	}
+	return maskedBody, int(size), false
+}
+
+// getUndecodedBody reports text bodies without a codec as a JSON string and
+// leaves anything else out
+func getUndecodedBody(contentType string, body []byte) json.RawMessage {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && strings.HasPrefix(mediaType, "text/") {
+		if text, err := json.Marshal(string(body)); err == nil {
+			return text
+		}
+	}
+	return json.RawMessage("{}")
+}
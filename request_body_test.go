@@ -0,0 +1,249 @@
+package treblle
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestBodyTee(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+
+	payload := `{"user":"bob","password":"secret"}`
+	body := newRequestBody(io.NopCloser(strings.NewReader(payload)), 1024)
+
+	read, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(read))
+
+	errorProvider := NewErrorProvider()
+	masked, size, truncated := body.info(http.Header{"Content-Type": {"application/json"}}, int64(len(payload)), errorProvider)
+	assert.JSONEq(t, `{"user":"bob","password":"*********"}`, string(masked))
+	assert.Equal(t, len(payload), size)
+	assert.False(t, truncated)
+	assert.Empty(t, errorProvider.GetErrors())
+}
+
+func TestRequestBodyOverLimit(t *testing.T) {
+	payload := strings.Repeat("a", 100)
+	body := newRequestBody(io.NopCloser(strings.NewReader(payload)), 10)
+
+	read, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(read))
+	assert.Equal(t, 10, body.captured.Len())
+
+	errorProvider := NewErrorProvider()
+	masked, size, truncated := body.info(http.Header{}, -1, errorProvider)
+	assert.Equal(t, json.RawMessage("{}"), masked)
+	assert.Equal(t, 100, size)
+	assert.True(t, truncated)
+	assert.Empty(t, errorProvider.GetErrors())
+}
+
+func TestRequestBodyPreview(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+
+	testCases := map[string]struct {
+		contentType string
+		body        string
+		limit       int
+		expected    string
+	}{
+		"json": {
+			contentType: "application/json",
+			body:        `[{"password":"a"},{"password":"b"}]`,
+			limit:       20,
+			expected:    `[{"password":"*********"}]`,
+		},
+		"ndjson": {
+			contentType: "application/x-ndjson",
+			body:        "{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n",
+			limit:       20,
+			expected:    `[{"id":1},{"id":2}]`,
+		},
+		"form": {
+			contentType: "application/x-www-form-urlencoded",
+			body:        "password=secret&scope=read&state=xyz",
+			limit:       28,
+			expected:    `{"password":"*********","scope":"read"}`,
+		},
+		"text": {
+			contentType: "text/plain; charset=utf-8",
+			body:        "h\u00e9llo",
+			limit:       2,
+			expected:    `"h"`,
+		},
+		"xml": {
+			contentType: "application/xml",
+			body:        `<user><id>1</id></user>`,
+			limit:       10,
+			expected:    `{}`,
+		},
+	}
+
+	for tn, tc := range testCases {
+		body := newRequestBody(nopBody(tc.body), tc.limit)
+		_, err := io.ReadAll(body)
+		require.NoError(t, err, tn)
+
+		errorProvider := NewErrorProvider()
+		masked, size, truncated := body.info(http.Header{"Content-Type": {tc.contentType}}, -1, errorProvider)
+		assert.JSONEq(t, tc.expected, string(masked), tn)
+		assert.Equal(t, len(tc.body), size, tn)
+		assert.True(t, truncated, tn)
+		assert.Empty(t, errorProvider.GetErrors(), tn)
+	}
+}
+
+func TestRequestBodyUsesContentLengthWhenUnread(t *testing.T) {
+	body := newRequestBody(io.NopCloser(strings.NewReader(strings.Repeat("a", 100))), 10)
+	// The handler only looked at the first few bytes
+	io.ReadFull(body, make([]byte, 5))
+
+	_, size, truncated := body.info(http.Header{}, 100, NewErrorProvider())
+	assert.Equal(t, 100, size)
+	assert.True(t, truncated)
+}
+
+func TestRequestBodyNotReadForTheHandler(t *testing.T) {
+	payload := `{"id":1}`
+	body := newRequestBody(io.NopCloser(strings.NewReader(payload)), 1024)
+
+	// A body the handler never read is reported by its declared size only
+	masked, size, truncated := body.info(http.Header{"Content-Type": {"application/json"}}, int64(len(payload)), NewErrorProvider())
+	assert.JSONEq(t, `{}`, string(masked))
+	assert.Equal(t, len(payload), size)
+	assert.True(t, truncated)
+}
+
+func TestGetRequestBodyRestoresBody(t *testing.T) {
+	Configure(Configuration{})
+
+	payload := `{"id":1}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+
+	masked, size, truncated := getRequestBody(r, NewErrorProvider())
+	assert.JSONEq(t, payload, string(masked))
+	assert.Equal(t, len(payload), size)
+	assert.False(t, truncated)
+
+	// The body can still be read in full afterwards
+	read, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(read))
+}
+
+func TestMiddlewareKeepsMaxBytesReader(t *testing.T) {
+	Configure(Configuration{
+		SDK_TOKEN:             "test-sdk-token",
+		API_KEY:               "test-api-key",
+		Endpoint:              "http://127.0.0.1:0",
+		MaxRequestCaptureSize: 16,
+	})
+	defer Configure(Configuration{MaxRequestCaptureSize: defaultMaxRequestSize})
+
+	var readErr error
+	var contentLength int64
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentLength = r.ContentLength
+		r.Body = http.MaxBytesReader(w, r.Body, 32)
+		_, readErr = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("a", 64))))
+
+	var maxBytesErr *http.MaxBytesError
+	assert.True(t, errors.As(readErr, &maxBytesErr))
+	assert.Equal(t, int64(64), contentLength)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestMiddlewareDoesNotWaitForUnreadBody(t *testing.T) {
+	sender := &MemorySender{}
+	Configure(Configuration{API_KEY: "test-api-key", Sender: sender})
+	defer Configure(Configuration{})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	// The upload never completes
+	upload, writer := io.Pipe()
+	defer writer.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload", upload)
+	r.ContentLength = 300 * 1024
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the middleware waited for the body the handler did not read")
+	}
+
+	require.Eventually(t, func() bool { return len(sender.Payloads()) == 1 }, time.Second, 5*time.Millisecond)
+	request := sender.Payloads()[0].Data.Request
+	assert.Equal(t, 300*1024, request.Size)
+	assert.True(t, request.Truncated)
+}
+
+func TestMiddlewareMasksFormBody(t *testing.T) {
+	received := make(chan MetaData, 1)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	Configure(Configuration{
+		SDK_TOKEN: "test-sdk-token",
+		API_KEY:   "test-api-key",
+		Endpoint:  treblleServer.URL,
+	})
+
+	var clientSecret string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		clientSecret = r.PostForm.Get("client_secret")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	form := "grant_type=password&username=bob&password=hunter2&client_id=app&client_secret=s3cr3t&scope=read&scope=write"
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// The handler still sees the real values
+	assert.Equal(t, "s3cr3t", clientSecret)
+
+	select {
+	case meta := <-received:
+		assert.Empty(t, meta.Data.Response.Errors)
+		assert.JSONEq(t, `{
+			"grant_type": "password",
+			"username": "bob",
+			"password": "*********",
+			"client_id": "app",
+			"client_secret": "*********",
+			"scope": ["read", "write"]
+		}`, string(meta.Data.Request.Body))
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Treblle payload")
+	}
+}
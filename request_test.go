@@ -125,7 +125,10 @@ func (s *TestSuite) TestResponseHeaderMasking() {
 				"Set-Cookie": []string{"session=abc123", "token=xyz789"},
 			},
 			expected: map[string]interface{}{
-				"Set-Cookie": []interface{}{"*********", "*********"},
+				"Set-Cookie": []interface{}{
+					map[string]interface{}{"name": "session", "value": "*********", "secure": false, "http_only": false},
+					map[string]interface{}{"name": "token", "value": "*********", "secure": false, "http_only": false},
+				},
 			},
 		},
 	}
@@ -143,7 +146,7 @@ func (s *TestSuite) TestResponseHeaderMasking() {
 		}
 
 		errorProvider := NewErrorProvider()
-		resp := getResponseInfo(rec, time.Now(), errorProvider)
+		resp := getResponseInfo(newResponseWriter(rec, maxResponseSize), time.Now(), errorProvider)
 		var headers map[string]interface{}
 		err := json.Unmarshal(resp.Headers, &headers)
 		s.Require().NoError(err, tn)
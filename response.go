@@ -3,54 +3,28 @@ package treblle
 import (
 	"encoding/json"
 	"fmt"
-	"net/http/httptest"
 	"time"
 )
 
-// Define the maximum response size (2MB in bytes)
+// Define the default number of response body bytes kept for Treblle (2MB)
 const maxResponseSize = 2 * 1024 * 1024
 
 type ResponseInfo struct {
-	Headers  json.RawMessage `json:"headers"`
-	Code     int             `json:"code"`
-	Size     int             `json:"size"`
-	LoadTime float64         `json:"load_time"`
-	Body     json.RawMessage `json:"body"`
-	Errors   []ErrorInfo     `json:"errors"`
+	Headers   json.RawMessage       `json:"headers"`
+	Code      int                   `json:"code"`
+	Size      int                   `json:"size"`
+	LoadTime  float64               `json:"load_time"`
+	Body      json.RawMessage       `json:"body"`
+	Truncated bool                  `json:"truncated,omitempty"`
+	Errors    []ErrorInfo           `json:"errors"`
+	SSE       *SSESessionInfo       `json:"sse,omitempty"`
+	WebSocket *WebSocketSessionInfo `json:"websocket,omitempty"`
 }
 
 // getResponseInfo extracts information from the response matching Laravel SDK structure
-func getResponseInfo(response *httptest.ResponseRecorder, startTime time.Time, errorProvider *ErrorProvider) ResponseInfo {
-	// Process headers (similar to Laravel's collect()->first())
-	headers := make(map[string]interface{})
-	for key, values := range response.Header() {
-		if len(values) == 0 {
-			continue
-		}
-		
-		// For multiple values, keep them as an array
-		if len(values) > 1 {
-			// If the field should be masked, mask each value
-			if shouldMaskField(key) {
-				maskedValues := make([]interface{}, len(values))
-				for i := range values {
-					maskedValues[i] = maskValue(values[i], key)
-				}
-				headers[key] = maskedValues
-			} else {
-				headers[key] = values
-			}
-		} else {
-			// Single value
-			if shouldMaskField(key) {
-				headers[key] = maskValue(values[0], key)
-			} else {
-				headers[key] = values[0]
-			}
-		}
-	}
-	
-	headerJSON, err := json.Marshal(headers)
+func getResponseInfo(response *responseWriter, startTime time.Time, errorProvider *ErrorProvider) ResponseInfo {
+	// Process headers
+	headerJSON, err := getMaskedHeaders(response.Header())
 	if err != nil {
 		headerJSON = json.RawMessage("{}")
 		errorProvider.AddCustomError(
@@ -60,67 +34,102 @@ func getResponseInfo(response *httptest.ResponseRecorder, startTime time.Time, e
 		)
 	}
 
-	// Get response body
-	body := response.Body.Bytes()
+	// Calculate load time in milliseconds (matching Laravel's precision)
+	loadTime := float64(time.Since(startTime).Microseconds()) / 1000.0
+
+	// Event streams are reported as a session summary instead of a body
+	if response.sse != nil {
+		bodyJSON, err := response.sse.body()
+		if err != nil {
+			bodyJSON = json.RawMessage("{}")
+			errorProvider.AddCustomError(
+				fmt.Sprintf("failed to marshal captured events: %v", err),
+				MarshalError,
+				"getResponseInfo",
+			)
+		}
+
+		return ResponseInfo{
+			Headers:  headerJSON,
+			Code:     response.Status(),
+			Size:     int(response.Size()),
+			LoadTime: loadTime,
+			Body:     bodyJSON,
+			Errors:   errorProvider.GetErrors(),
+			SSE:      response.sse.session(startTime),
+		}
+	}
+
+	// Get response body. Bodies larger than the capture limit are reported
+	// as a preview of the captured prefix together with their real size.
+	body := response.Body()
+	truncated := response.Size() > int64(len(body))
 	var bodyJSON json.RawMessage
-	var size int
 	if len(body) > 0 {
-		if len(body) > maxResponseSize {
-			// Replace with empty JSON object
+		// Decompress encoded bodies before masking, the client still
+		// receives the encoded bytes. Bodies expanding beyond the
+		// decompression ratio or the capture limit are previewed too.
+		var decodeErr error
+		if encoding := response.Header().Get("Content-Encoding"); isContentEncoded(encoding) {
+			var cut bool
+			body, cut, decodeErr = decodeContent(encoding, body, Config.MaxDecompressionRatio, response.limit, truncated)
+			truncated = truncated || cut
+		}
+
+		if decodeErr != nil {
 			bodyJSON = json.RawMessage("{}")
-			// Set size to 0 as we're not sending the actual body
-			size = 0
 			errorProvider.AddCustomError(
-				"JSON response size is over 2MB",
-				ServerError,
-				"response_size_limit",
+				fmt.Sprintf("failed to decode response body: %v", decodeErr),
+				MarshalError,
+				"getResponseInfo",
 			)
-		} else {
-			// Check if response is JSON
-			contentType := response.Header().Get("Content-Type")
-			if contentType == "application/json" {
-				maskedBody, err := getMaskedJSON(body)
-				if err != nil {
-					bodyJSON = json.RawMessage("{}")
-					errorProvider.AddCustomError(
-						fmt.Sprintf("failed to mask response body: %v", err),
-						MarshalError,
-						"getResponseInfo",
-					)
-				} else {
-					bodyJSON = maskedBody
+		} else if codec, ok := lookupBodyCodec(response.Header().Get("Content-Type")); ok {
+			// Mask bodies of media types with a registered codec
+			if truncated {
+				preview, ok := getBodyPreview(codec, body)
+				if !ok {
+					preview = json.RawMessage("{}")
 				}
+				bodyJSON = preview
+			} else if maskedBody, err := getMaskedBody(codec, body); err != nil {
+				bodyJSON = json.RawMessage("{}")
+				errorProvider.AddCustomError(
+					fmt.Sprintf("failed to mask response body: %v", err),
+					MarshalError,
+					"getResponseInfo",
+				)
 			} else {
-				// For non-JSON responses, wrap the raw string in JSON quotes
-				bodyStr := string(body)
-				bodyBytes, err := json.Marshal(bodyStr)
-				if err != nil {
-					bodyJSON = json.RawMessage("{}")
-					errorProvider.AddCustomError(
-						fmt.Sprintf("failed to marshal non-JSON response: %v", err),
-						MarshalError,
-						"getResponseInfo",
-					)
-				} else {
-					bodyJSON = bodyBytes
-				}
+				bodyJSON = maskedBody
+			}
+		} else {
+			// For other responses, wrap the raw string in JSON quotes
+			if truncated {
+				body = trimPartialRune(body)
+			}
+			bodyStr := string(body)
+			bodyBytes, err := json.Marshal(bodyStr)
+			if err != nil {
+				bodyJSON = json.RawMessage("{}")
+				errorProvider.AddCustomError(
+					fmt.Sprintf("failed to marshal non-JSON response: %v", err),
+					MarshalError,
+					"getResponseInfo",
+				)
+			} else {
+				bodyJSON = bodyBytes
 			}
-			size = len(body)
 		}
 	} else {
 		bodyJSON = json.RawMessage("{}")
-		size = 0
 	}
 
-	// Calculate load time in milliseconds (matching Laravel's precision)
-	loadTime := float64(time.Since(startTime).Microseconds()) / 1000.0
-
 	return ResponseInfo{
-		Headers:  headerJSON,
-		Code:     response.Code,
-		Size:     size,
-		LoadTime: loadTime,
-		Body:     bodyJSON,
-		Errors:   errorProvider.GetErrors(),
+		Headers:   headerJSON,
+		Code:      response.Status(),
+		Size:      int(response.Size()),
+		LoadTime:  loadTime,
+		Body:      bodyJSON,
+		Truncated: truncated,
+		Errors:    errorProvider.GetErrors(),
 	}
 }
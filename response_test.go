@@ -8,47 +8,91 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestResponseSizeLimit(t *testing.T) {
 	// Create a new error provider
 	errorProvider := NewErrorProvider()
 
-	// Create a response recorder
-	w := httptest.NewRecorder()
+	// Create a response writer backed by a recorder
+	w := newResponseWriter(httptest.NewRecorder(), maxResponseSize)
 	
-	// Generate a response body that exceeds 2MB
+	// Generate a response body that exceeds the 2MB capture limit
 	largeBody := strings.Repeat("a", maxResponseSize+1)
-	w.WriteString(largeBody)
+	w.Write([]byte(largeBody))
 	
 	// Get the response info
 	startTime := time.Now().Add(-100 * time.Millisecond) // Simulate some processing time
 	responseInfo := getResponseInfo(w, startTime, errorProvider)
 	
-	// Verify the response body was replaced with an empty JSON object
-	assert.Equal(t, json.RawMessage("{}"), responseInfo.Body)
-	
-	// Verify the size was set to 0
-	assert.Equal(t, 0, responseInfo.Size)
-	
-	// Verify an error was added
-	errors := errorProvider.GetErrors()
-	assert.Len(t, errors, 1)
-	assert.Equal(t, "JSON response size is over 2MB", errors[0].Message)
-	assert.Equal(t, ServerError, errors[0].Type)
-	assert.Equal(t, "response_size_limit", errors[0].Source)
+	// Verify the response body was replaced with a preview of the captured prefix
+	var preview string
+	require.NoError(t, json.Unmarshal(responseInfo.Body, &preview))
+	assert.Equal(t, largeBody[:maxResponseSize], preview)
+	assert.True(t, responseInfo.Truncated)
+
+	// Verify the real size is still reported
+	assert.Equal(t, maxResponseSize+1, responseInfo.Size)
+
+	// Verify truncation is not reported as an error
+	assert.Empty(t, errorProvider.GetErrors())
+}
+
+func TestResponseJSONPreview(t *testing.T) {
+	Configure(Configuration{DefaultFieldsToMask: []string{"password"}})
+
+	testCases := map[string]struct {
+		body     string
+		limit    int
+		expected string
+	}{
+		"object": {
+			body:     `{"password":"secret","id":1,"items":[1,2,3]}`,
+			limit:    36,
+			expected: `{"password":"*********","id":1}`,
+		},
+		"array": {
+			body:     `[{"password":"a"},{"password":"b"},{"password":"c"}]`,
+			limit:    40,
+			expected: `[{"password":"*********"},{"password":"*********"}]`,
+		},
+		"first-member-cut": {
+			body:     `{"items":[1,2,3]}`,
+			limit:    12,
+			expected: `{}`,
+		},
+		"scalar": {
+			body:     `"a long string"`,
+			limit:    5,
+			expected: `{}`,
+		},
+	}
+
+	for tn, tc := range testCases {
+		errorProvider := NewErrorProvider()
+		w := newResponseWriter(httptest.NewRecorder(), tc.limit)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(tc.body))
+
+		responseInfo := getResponseInfo(w, time.Now(), errorProvider)
+		assert.JSONEq(t, tc.expected, string(responseInfo.Body), tn)
+		assert.Equal(t, len(tc.body), responseInfo.Size, tn)
+		assert.True(t, responseInfo.Truncated, tn)
+		assert.Empty(t, errorProvider.GetErrors(), tn)
+	}
 }
 
 func TestResponseSizeLimitNotExceeded(t *testing.T) {
 	// Create a new error provider
 	errorProvider := NewErrorProvider()
 
-	// Create a response recorder
-	w := httptest.NewRecorder()
+	// Create a response writer backed by a recorder
+	w := newResponseWriter(httptest.NewRecorder(), maxResponseSize)
 	
 	// Generate a valid JSON response body that does not exceed 2MB
 	smallBody := `{"test":"data"}`
-	w.WriteString(smallBody)
+	w.Write([]byte(smallBody))
 	
 	// Get the response info
 	startTime := time.Now().Add(-100 * time.Millisecond) // Simulate some processing time
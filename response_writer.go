@@ -0,0 +1,171 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+)
+
+// responseWriter wraps the http.ResponseWriter handed to the middleware.
+// Everything the handler writes goes straight through to the client, while a
+// bounded prefix of the body is kept so it can be reported to Treblle.
+//
+// It implements http.Flusher, http.Hijacker and io.ReaderFrom and exposes the
+// original writer through Unwrap, so streaming handlers, connection upgrades,
+// file downloads and http.ResponseController keep working behind Treblle.
+type responseWriter struct {
+	http.ResponseWriter
+
+	status      int
+	wroteHeader bool
+	hijacked    bool
+	size        int64
+	limit       int
+	body        bytes.Buffer
+
+	// sse is set when the response turns out to be an event stream
+	sse *sseTracker
+	// onWebSocketClose is set for upgrade requests and receives the session
+	// summary once the hijacked connection is closed
+	onWebSocketClose func(*WebSocketSessionInfo)
+}
+
+// newResponseWriter wraps w, keeping at most limit bytes of the response body
+func newResponseWriter(w http.ResponseWriter, limit int) *responseWriter {
+	return &responseWriter{
+		ResponseWriter: w,
+		status:         http.StatusOK,
+		limit:          limit,
+	}
+}
+
+// WriteHeader records the status code and forwards it to the client.
+// Informational (1xx) responses other than 101 are forwarded without being
+// recorded, since the final status code is still to come.
+func (rw *responseWriter) WriteHeader(code int) {
+	if !rw.wroteHeader && (code < 100 || code > 199 || code == http.StatusSwitchingProtocols) {
+		rw.status = code
+		rw.commit()
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends b to the client and copies it into the capture buffer while
+// there is room left
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	// Let the underlying writer send the implicit 200 so content sniffing
+	// still happens there
+	rw.commit()
+
+	n, err := rw.ResponseWriter.Write(b)
+	rw.capture(b[:n])
+	rw.size += int64(n)
+	if err != nil && rw.sse != nil {
+		rw.sse.close(true)
+	}
+	return n, err
+}
+
+// ReadFrom copies src to the client. Only the part of src that still fits in
+// the capture buffer goes through Write; the remainder is handed to the
+// underlying io.ReaderFrom so optimisations such as sendfile are preserved.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := rw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{rw}, src)
+	}
+
+	rw.commit()
+	if rw.sse != nil {
+		return io.Copy(writerOnly{rw}, src)
+	}
+
+	var n int64
+	if room := int64(rw.limit - rw.body.Len()); room > 0 {
+		copied, err := io.Copy(writerOnly{rw}, io.LimitReader(src, room))
+		n += copied
+		if err != nil || copied < room {
+			return n, err
+		}
+	}
+
+	copied, err := rf.ReadFrom(src)
+	rw.size += copied
+	return n + copied, err
+}
+
+// Flush sends any buffered data to the client
+func (rw *responseWriter) Flush() {
+	rw.commit()
+	_ = http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Hijack lets the handler take over the connection
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	rw.hijacked = true
+
+	if rw.onWebSocketClose != nil {
+		conn, brw = hijackWebSocket(conn, brw, rw.wroteHeader, rw.onWebSocketClose)
+	}
+	return conn, brw, nil
+}
+
+// Unwrap returns the original http.ResponseWriter, used by http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Status returns the status code sent to the client
+func (rw *responseWriter) Status() int {
+	return rw.status
+}
+
+// Size returns the number of body bytes sent to the client
+func (rw *responseWriter) Size() int64 {
+	return rw.size
+}
+
+// Body returns the captured prefix of the response body
+func (rw *responseWriter) Body() []byte {
+	return rw.body.Bytes()
+}
+
+// commit marks the headers as sent and switches to event stream tracking
+// when the handler declared a text/event-stream response
+func (rw *responseWriter) commit() {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	if isEventStream(rw.Header()) {
+		rw.sse = newSSETracker(Config.SSECaptureEvents)
+	}
+}
+
+func (rw *responseWriter) capture(b []byte) {
+	if rw.sse != nil {
+		rw.sse.write(b)
+		return
+	}
+
+	room := rw.limit - rw.body.Len()
+	if room <= 0 {
+		return
+	}
+	if len(b) > room {
+		b = b[:room]
+	}
+	rw.body.Write(b)
+}
+
+// writerOnly hides the ReadFrom method of the wrapped writer so io.Copy
+// does not recurse back into responseWriter.ReadFrom
+type writerOnly struct {
+	io.Writer
+}
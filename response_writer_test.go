@@ -0,0 +1,138 @@
+package treblle
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseWriterCapture(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := newResponseWriter(rec, 5)
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write([]byte("hello "))
+	rw.Write([]byte("world"))
+
+	// The client receives everything, Treblle only the bounded prefix
+	assert.Equal(t, "hello world", rec.Body.String())
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "hello", string(rw.Body()))
+	assert.Equal(t, int64(11), rw.Size())
+	assert.Equal(t, http.StatusCreated, rw.Status())
+}
+
+func TestResponseWriterIgnoresInformationalStatus(t *testing.T) {
+	rw := newResponseWriter(httptest.NewRecorder(), 10)
+
+	rw.WriteHeader(http.StatusEarlyHints)
+	rw.WriteHeader(http.StatusAccepted)
+
+	assert.Equal(t, http.StatusAccepted, rw.Status())
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	content := strings.Repeat("x", 4096)
+	path := filepath.Join(t.TempDir(), "download.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := newResponseWriter(w, 100)
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		n, err := io.Copy(rw, f)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, int64(len(content)), rw.Size())
+		assert.Equal(t, content[:100], string(rw.Body()))
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(body))
+}
+
+func TestMiddlewareStreamsResponse(t *testing.T) {
+	Configure(Configuration{
+		SDK_TOKEN: "test-sdk-token",
+		API_KEY:   "test-api-key",
+		Endpoint:  "http://127.0.0.1:0",
+	})
+
+	release := make(chan struct{})
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		flusher.Flush()
+
+		// Block until the client has seen the first event
+		<-release
+		w.Write([]byte("data: second\n\n"))
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+
+	close(release)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+}
+
+func TestMiddlewareHijack(t *testing.T) {
+	Configure(Configuration{
+		SDK_TOKEN: "test-sdk-token",
+		API_KEY:   "test-api-key",
+		Endpoint:  "http://127.0.0.1:0",
+	})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		brw.Flush()
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hijacked", string(body))
+}
@@ -0,0 +1,120 @@
+package treblle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxSendRetries = 3
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 2 * time.Second
+
+	// idempotencyKeyHeader carries a key shared by every attempt of a
+	// payload, so a retried payload is only counted once
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotencyKeyContextKey carries the key of a payload already sent
+	// under one, such as a payload replayed from the spool
+	idempotencyKeyContextKey contextKey = "treblle_idempotency_key"
+)
+
+// sendError is the failure of one attempt to post a payload
+type sendError struct {
+	err        error
+	status     int
+	retryable  bool
+	retryAfter time.Duration
+}
+
+func (e *sendError) Error() string { return e.err.Error() }
+
+func (e *sendError) Unwrap() error { return e.err }
+
+// isRetryableStatus reports whether a response status is worth retrying
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// retryBackoff returns the jittered exponential backoff before retry
+// number attempt, counted from 0: half the doubled delay plus up to as much
+// again at random, capped at RetryMaxDelay
+func retryBackoff(attempt int) time.Duration {
+	base, max := Config.RetryBaseDelay, Config.RetryMaxDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if max <= 0 {
+		max = defaultRetryMaxDelay
+	}
+
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(mathrand.Int63n(int64(delay-half)+1))
+}
+
+// sleepContext waits for d, returning early with the context error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newIdempotencyKey returns a random key identifying one payload
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	return hex.EncodeToString(key)
+}
+
+// withIdempotencyKey returns a context delivering payloads under key
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey, key)
+}
+
+// payloadIdempotencyKey returns the key of ctx, or a new one when it has none
+func payloadIdempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyContextKey).(string); ok && key != "" {
+		return key
+	}
+	return newIdempotencyKey()
+}
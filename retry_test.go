@@ -0,0 +1,174 @@
+package treblle
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := map[string]struct {
+		delay time.Duration
+		ok    bool
+	}{
+		"":                              {0, false},
+		"3":                             {3 * time.Second, true},
+		"-1":                            {0, false},
+		"soon":                          {0, false},
+		"Tue, 01 Jan 2030 00:00:10 GMT": {10 * time.Second, true},
+		"Mon, 31 Dec 2029 23:59:00 GMT": {0, true},
+	}
+
+	for value, expected := range testCases {
+		delay, ok := parseRetryAfter(value, now)
+		assert.Equal(t, expected.ok, ok, value)
+		assert.Equal(t, expected.delay, delay, value)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	Configure(Configuration{RetryBaseDelay: 100 * time.Millisecond, RetryMaxDelay: time.Second})
+	defer Configure(Configuration{})
+
+	for i := 0; i < 100; i++ {
+		first := retryBackoff(0)
+		assert.True(t, first >= 50*time.Millisecond && first <= 100*time.Millisecond, first)
+		third := retryBackoff(2)
+		assert.True(t, third >= 200*time.Millisecond && third <= 400*time.Millisecond, third)
+		capped := retryBackoff(20)
+		assert.True(t, capped >= 500*time.Millisecond && capped <= time.Second, capped)
+	}
+}
+
+// recordingServer answers with the given statuses in turn, then 200, and
+// records the idempotency keys it receives
+type recordingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	keys     []string
+}
+
+func newRecordingServer(headers http.Header, statuses ...int) *recordingServer {
+	s := &recordingServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.keys = append(s.keys, r.Header.Get(idempotencyKeyHeader))
+		if len(s.statuses) > 0 {
+			for key, values := range headers {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	return s
+}
+
+func (s *recordingServer) attempts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func TestHTTPSenderRetries(t *testing.T) {
+	Configure(Configuration{RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond})
+	defer Configure(Configuration{})
+
+	t.Run("retries server errors with one idempotency key", func(t *testing.T) {
+		server := newRecordingServer(nil, http.StatusServiceUnavailable, http.StatusBadGateway)
+		defer server.Close()
+
+		require.NoError(t, (&HTTPSender{Endpoint: server.URL}).Send(context.Background(), MetaData{}))
+		keys := server.attempts()
+		require.Len(t, keys, 3)
+		assert.NotEmpty(t, keys[0])
+		assert.Equal(t, keys[0], keys[1])
+		assert.Equal(t, keys[0], keys[2])
+	})
+
+	t.Run("gives up after the configured retries", func(t *testing.T) {
+		server := newRecordingServer(nil, 500, 500, 500, 500, 500)
+		defer server.Close()
+
+		assert.Error(t, (&HTTPSender{Endpoint: server.URL}).Send(context.Background(), MetaData{}))
+		assert.Len(t, server.attempts(), 4)
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		server := newRecordingServer(nil, http.StatusBadRequest)
+		defer server.Close()
+
+		assert.Error(t, (&HTTPSender{Endpoint: server.URL}).Send(context.Background(), MetaData{}))
+		assert.Len(t, server.attempts(), 1)
+	})
+
+	t.Run("honours Retry-After", func(t *testing.T) {
+		server := newRecordingServer(http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests)
+		defer server.Close()
+
+		start := time.Now()
+		require.NoError(t, (&HTTPSender{Endpoint: server.URL}).Send(context.Background(), MetaData{}))
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+		assert.Len(t, server.attempts(), 2)
+	})
+
+	t.Run("stops when Retry-After exceeds the deadline", func(t *testing.T) {
+		server := newRecordingServer(http.Header{"Retry-After": {"60"}}, http.StatusTooManyRequests)
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		start := time.Now()
+		assert.Error(t, (&HTTPSender{Endpoint: server.URL}).Send(ctx, MetaData{}))
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Len(t, server.attempts(), 1)
+	})
+
+	t.Run("disabled retries", func(t *testing.T) {
+		Configure(Configuration{MaxSendRetries: -1})
+		defer Configure(Configuration{RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond})
+
+		server := newRecordingServer(nil, http.StatusServiceUnavailable)
+		defer server.Close()
+
+		assert.Error(t, (&HTTPSender{Endpoint: server.URL}).Send(context.Background(), MetaData{}))
+		assert.Len(t, server.attempts(), 1)
+	})
+}
+
+func TestHTTPSenderFailsOverAcrossBaseUrls(t *testing.T) {
+	Configure(Configuration{RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond})
+	defer Configure(Configuration{})
+
+	down := newRecordingServer(nil)
+	down.Close()
+	failing := newRecordingServer(nil, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer failing.Close()
+	healthy := newRecordingServer(nil)
+	defer healthy.Close()
+
+	originalUrls, originalEndpoint := treblleBaseUrls, Config.Endpoint
+	treblleBaseUrls, Config.Endpoint = []string{down.URL, failing.URL, healthy.URL}, ""
+	defer func() { treblleBaseUrls, Config.Endpoint = originalUrls, originalEndpoint }()
+
+	urls := getTreblleBaseUrls()
+	assert.ElementsMatch(t, treblleBaseUrls, urls)
+
+	// Whichever endpoint comes first, the payload reaches the healthy one
+	// within the configured retries
+	require.NoError(t, (&HTTPSender{}).Send(context.Background(), MetaData{}))
+	require.Len(t, healthy.attempts(), 1)
+	for _, key := range failing.attempts() {
+		assert.Equal(t, healthy.attempts()[0], key)
+	}
+}
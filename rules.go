@@ -0,0 +1,205 @@
+package treblle
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RuleAction decides what is reported for requests matching a Rule
+type RuleAction string
+
+const (
+	RuleSkip     RuleAction = "skip"     // Do not report the request
+	RuleMetadata RuleAction = "metadata" // Report the request without request and response bodies
+	RuleFull     RuleAction = "full"     // Report the request with its bodies
+)
+
+// StatusRange matches response status codes from Min to Max, inclusive
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Rule selects requests on every condition it sets. Conditions left empty
+// match any request, and a condition with several values matches when any
+// of them does.
+type Rule struct {
+	Paths       []string      // Path globs or route templates, e.g. "/health", "/static/**", "/users/{id}"
+	Methods     []string      // HTTP methods, e.g. "OPTIONS"
+	StatusCodes []StatusRange // Response status code ranges, e.g. {Min: 500, Max: 599}
+	Hosts       []string      // Host globs, e.g. "*.internal"
+	UserAgents  []string      // User-Agent globs, e.g. "kube-probe/*"
+	Action      RuleAction    // What to report for matching requests (default: skip)
+}
+
+func (rule Rule) action() RuleAction {
+	if rule.Action == "" {
+		return RuleSkip
+	}
+	return rule.Action
+}
+
+// evaluateRules returns the action of the first rule matching r, or RuleFull
+// when none does. Pass a zero status while the response is still unknown:
+// decided is then false if a rule on status codes could still match ahead
+// of the returned action.
+func evaluateRules(rules []Rule, r *http.Request, status int) (action RuleAction, decided bool) {
+	for _, rule := range rules {
+		if !rule.matchesRequest(r) {
+			continue
+		}
+		if len(rule.StatusCodes) == 0 {
+			return rule.action(), true
+		}
+		if status == 0 {
+			return RuleFull, false
+		}
+		if rule.matchesStatus(status) {
+			return rule.action(), true
+		}
+	}
+	return RuleFull, true
+}
+
+func (rule Rule) matchesRequest(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+		return false
+	}
+
+	if len(rule.Paths) > 0 {
+		routePath := GetRoutePath(r)
+		matched := false
+		for _, pattern := range rule.Paths {
+			if matchPath(pattern, r.URL.Path) || (routePath != "" && matchPath(pattern, normalizeRoutePath(routePath))) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.Hosts) > 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !matchAnyGlob(rule.Hosts, host) {
+			return false
+		}
+	}
+
+	if len(rule.UserAgents) > 0 && !matchAnyGlob(rule.UserAgents, r.UserAgent()) {
+		return false
+	}
+
+	return true
+}
+
+func (rule Rule) matchesStatus(status int) bool {
+	for _, codes := range rule.StatusCodes {
+		if status >= codes.Min && status <= codes.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath matches a URL path segment by segment. A "**" segment matches
+// any number of segments, "{name}" and ":name" segments match exactly one,
+// and other segments are globs as understood by path.Match.
+func matchPath(pattern, urlPath string) bool {
+	return matchSegments(
+		strings.Split(strings.Trim(pattern, "/"), "/"),
+		strings.Split(strings.Trim(urlPath, "/"), "/"),
+	)
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		head := pattern[0]
+		if head == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+
+		isParam := (strings.HasPrefix(head, "{") && strings.HasSuffix(head, "}")) || strings.HasPrefix(head, ":")
+		if !isParam {
+			if ok, err := path.Match(head, segments[0]); err != nil || !ok {
+				return false
+			}
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// matchAnyGlob reports whether s matches any of the case-insensitive globs,
+// where "*" matches any run of characters and "?" a single character
+func matchAnyGlob(patterns []string, s string) bool {
+	s = strings.ToLower(s)
+	for _, pattern := range patterns {
+		if matchGlob(strings.ToLower(pattern), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(pattern, s string) bool {
+	// Backtrack to the last star on a mismatch
+	star, next := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropBodies removes the bodies of a request reported as metadata only,
+// keeping their sizes
+func dropBodies(requestInfo *RequestInfo, responseInfo *ResponseInfo, contentLength int64) {
+	if requestInfo.Body == nil && contentLength > 0 {
+		requestInfo.Size = int(contentLength)
+	}
+	requestInfo.Body = nil
+	requestInfo.Truncated = false
+	responseInfo.Body = json.RawMessage("{}")
+	responseInfo.Truncated = false
+}
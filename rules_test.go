@@ -0,0 +1,146 @@
+package treblle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPath(t *testing.T) {
+	testCases := map[string]struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		"exact":               {"/health", "/health", true},
+		"trailing-slash":      {"/health", "/health/", true},
+		"other":               {"/health", "/healthz", false},
+		"glob":                {"/health*", "/healthz", true},
+		"star-one-segment":    {"/static/*", "/static/app/main.js", false},
+		"double-star":         {"/static/**", "/static/app/main.js", true},
+		"double-star-root":    {"/static/**", "/static", true},
+		"double-star-middle":  {"/api/**/metrics", "/api/v1/internal/metrics", true},
+		"extension":           {"/**/*.css", "/assets/css/site.css", true},
+		"template-braces":     {"/users/{id}", "/users/42", true},
+		"template-colon":      {"/users/:id/posts", "/users/42/posts", true},
+		"template-too-long":   {"/users/{id}", "/users/42/posts", false},
+		"template-constraint": {"/users/{id:[0-9]+}", "/users/42", true},
+	}
+
+	for tn, tc := range testCases {
+		assert.Equal(t, tc.expected, matchPath(tc.pattern, tc.path), tn)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	assert.True(t, matchAnyGlob([]string{"kube-probe/*"}, "kube-probe/1.27"))
+	assert.True(t, matchAnyGlob([]string{"*bot*"}, "Mozilla/5.0 (compatible; Googlebot/2.1)"))
+	assert.True(t, matchAnyGlob([]string{"*.INTERNAL"}, "api.svc.internal"))
+	assert.True(t, matchAnyGlob([]string{"v?"}, "v1"))
+	assert.False(t, matchAnyGlob([]string{"*.internal"}, "internal"))
+	assert.False(t, matchAnyGlob([]string{"curl/*"}, "Wget/1.21"))
+}
+
+func TestEvaluateRules(t *testing.T) {
+	rules := []Rule{
+		{Methods: []string{"OPTIONS"}},
+		{Paths: []string{"/health", "/metrics"}},
+		{Hosts: []string{"*.internal"}, Action: RuleMetadata},
+		{UserAgents: []string{"kube-probe/*"}},
+		{Paths: []string{"/files/**"}, StatusCodes: []StatusRange{{Min: 200, Max: 299}}, Action: RuleMetadata},
+		{Paths: []string{"/files/**"}, Action: RuleFull},
+	}
+
+	testCases := map[string]struct {
+		method    string
+		target    string
+		userAgent string
+		status    int
+		action    RuleAction
+		decided   bool
+	}{
+		"preflight":       {http.MethodOptions, "/users", "", 0, RuleSkip, true},
+		"health":          {http.MethodGet, "/health", "", 0, RuleSkip, true},
+		"internal-host":   {http.MethodGet, "http://billing.internal:8080/users", "", 0, RuleMetadata, true},
+		"user-agent":      {http.MethodGet, "/users", "kube-probe/1.27", 0, RuleSkip, true},
+		"no-match":        {http.MethodGet, "/users", "", 0, RuleFull, true},
+		"status-pending":  {http.MethodGet, "/files/report.pdf", "", 0, RuleFull, false},
+		"status-matched":  {http.MethodGet, "/files/report.pdf", "", 200, RuleMetadata, true},
+		"status-fallback": {http.MethodGet, "/files/report.pdf", "", 404, RuleFull, true},
+	}
+
+	for tn, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		r.Header.Set("User-Agent", tc.userAgent)
+
+		action, decided := evaluateRules(rules, r, tc.status)
+		assert.Equal(t, tc.action, action, tn)
+		assert.Equal(t, tc.decided, decided, tn)
+	}
+}
+
+func TestEvaluateRulesRoutePath(t *testing.T) {
+	rules := []Rule{{Paths: []string{"/users/{id}"}}}
+
+	r := SetRoutePath(httptest.NewRequest(http.MethodGet, "/v2/users/42", nil), "/users/{id}")
+	action, _ := evaluateRules(rules, r, 0)
+	assert.Equal(t, RuleSkip, action)
+}
+
+func TestMiddlewareRules(t *testing.T) {
+	received := make(chan MetaData, 4)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	Configure(Configuration{
+		SDK_TOKEN: "test-sdk-token",
+		API_KEY:   "test-api-key",
+		Endpoint:  treblleServer.URL,
+		Rules: []Rule{
+			{Paths: []string{"/health"}},
+			{Paths: []string{"/login"}, Action: RuleMetadata},
+			{StatusCodes: []StatusRange{{Min: 404, Max: 404}}},
+		},
+	})
+	defer Configure(Configuration{})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token":"abc"}`))
+	}))
+
+	for _, target := range []string{"/health", "/missing", "/login"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"user":"bob"}`)))
+	}
+
+	select {
+	case meta := <-received:
+		assert.Contains(t, meta.Data.Request.Url, "/login")
+		assert.JSONEq(t, `null`, string(meta.Data.Request.Body))
+		assert.Equal(t, len(`{"user":"bob"}`), meta.Data.Request.Size)
+		assert.JSONEq(t, `{}`, string(meta.Data.Response.Body))
+		assert.Equal(t, len(`{"token":"abc"}`), meta.Data.Response.Size)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Treblle payload")
+	}
+
+	select {
+	case meta := <-received:
+		t.Fatalf("unexpected payload for %s", meta.Data.Request.Url)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
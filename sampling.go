@@ -0,0 +1,92 @@
+package treblle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultSampleIDHeaders hold request or trace IDs shared by every service
+// handling a request, so they all make the same sampling decision
+var defaultSampleIDHeaders = []string{"traceparent", "X-B3-TraceId", "X-Request-ID", "X-Correlation-ID"}
+
+// RouteSampleRate sets the sample rate of requests matching any of Paths,
+// which take the same globs and route templates as Rule.Paths
+type RouteSampleRate struct {
+	Paths []string // Path globs or route templates, e.g. "/search/**"
+	Rate  float64  // Fraction of matching requests reported, from 0 to 1. At 0 only errors and slow requests are
+}
+
+// sampleRate returns the rate requests like r are sampled at. The first
+// matching route rate wins over the global rate.
+func sampleRate(r *http.Request) float64 {
+	for _, route := range Config.RouteSampleRates {
+		if (Rule{Paths: route.Paths}).matchesRequest(r) {
+			return route.Rate
+		}
+	}
+	return Config.SampleRate
+}
+
+// sampleRequest decides whether r is part of the sample. Requests carrying
+// a request or trace ID are sampled deterministically on that ID.
+func sampleRequest(r *http.Request, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+
+	if id := sampleID(r); id != "" {
+		sum := sha256.Sum256([]byte(id))
+		// Map the hash onto [0, 1) using its top 53 bits
+		return float64(binary.BigEndian.Uint64(sum[:8])>>11)/(1<<53) < rate
+	}
+	return rand.Float64() < rate
+}
+
+// sampleID returns the first request or trace ID found in the headers
+func sampleID(r *http.Request) string {
+	for _, header := range Config.SampleIDHeaders {
+		value := strings.TrimSpace(r.Header.Get(header))
+		if value == "" {
+			continue
+		}
+		// Only the trace ID of a W3C traceparent is shared between services
+		if strings.EqualFold(header, "traceparent") {
+			if parts := strings.Split(value, "-"); len(parts) == 4 {
+				value = parts[1]
+			}
+		}
+		return strings.ToLower(value)
+	}
+	return ""
+}
+
+// keepUnsampled reports whether a request is reported whatever its sample
+// rate: error responses, requests with collected errors and slow requests
+func keepUnsampled(status int, latency time.Duration, errorProvider *ErrorProvider) bool {
+	if status >= 400 || len(errorProvider.GetErrors()) > 0 {
+		return true
+	}
+	return Config.SampleKeepSlowerThan > 0 && latency >= Config.SampleKeepSlowerThan
+}
+
+// applySampling decides whether a finished request is reported and returns
+// the rate to report with it so counts can be extrapolated. Requests kept
+// regardless of sampling are reported with a rate of 1.
+func applySampling(r *http.Request, status int, latency time.Duration, errorProvider *ErrorProvider) (float64, bool) {
+	rate := sampleRate(r)
+	if rate >= 1 || keepUnsampled(status, latency, errorProvider) {
+		return 1, true
+	}
+	if !sampleRequest(r, rate) {
+		telemetry.sampledOut.Add(1)
+		return rate, false
+	}
+	return rate, true
+}
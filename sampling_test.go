@@ -0,0 +1,221 @@
+package treblle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleRate(t *testing.T) {
+	half := 0.5
+	Configure(Configuration{
+		SampleRate: &half,
+		RouteSampleRates: []RouteSampleRate{
+			{Paths: []string{"/search/**"}, Rate: 0.01},
+			{Paths: []string{"/orders/{id}"}, Rate: 1},
+		},
+	})
+	defer Configure(Configuration{})
+
+	assert.Equal(t, 0.01, sampleRate(httptest.NewRequest(http.MethodGet, "/search/users", nil)))
+	assert.Equal(t, 1.0, sampleRate(httptest.NewRequest(http.MethodGet, "/orders/42", nil)))
+	assert.Equal(t, 0.5, sampleRate(httptest.NewRequest(http.MethodGet, "/users", nil)))
+
+	// Unset reports every request, out of range rates are clamped
+	Configure(Configuration{})
+	assert.Equal(t, 1.0, sampleRate(httptest.NewRequest(http.MethodGet, "/users", nil)))
+	tooHigh, negative, zero := 3.0, -1.0, 0.0
+	Configure(Configuration{SampleRate: &tooHigh})
+	assert.Equal(t, 1.0, sampleRate(httptest.NewRequest(http.MethodGet, "/users", nil)))
+	Configure(Configuration{SampleRate: &negative})
+	assert.Equal(t, 0.0, sampleRate(httptest.NewRequest(http.MethodGet, "/users", nil)))
+	Configure(Configuration{SampleRate: &zero})
+	assert.Equal(t, 0.0, sampleRate(httptest.NewRequest(http.MethodGet, "/users", nil)))
+}
+
+func TestSampleRequestDeterministic(t *testing.T) {
+	Configure(Configuration{})
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-ID", fmt.Sprintf("request-%d", i))
+
+		decision := sampleRequest(r, 0.25)
+		// Every service seeing the same ID makes the same decision
+		for j := 0; j < 3; j++ {
+			assert.Equal(t, decision, sampleRequest(r, 0.25))
+		}
+		if decision {
+			kept++
+		}
+	}
+	assert.InDelta(t, 250, kept, 60)
+
+	assert.True(t, sampleRequest(httptest.NewRequest(http.MethodGet, "/", nil), 1))
+	assert.False(t, sampleRequest(httptest.NewRequest(http.MethodGet, "/", nil), 0))
+}
+
+func TestSampleIDFromTraceparent(t *testing.T) {
+	Configure(Configuration{})
+
+	// Services see different span IDs for the same trace
+	first := httptest.NewRequest(http.MethodGet, "/", nil)
+	first.Header.Set("traceparent", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01")
+	second := httptest.NewRequest(http.MethodGet, "/", nil)
+	second.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01")
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sampleID(first))
+	assert.Equal(t, sampleID(first), sampleID(second))
+	assert.Empty(t, sampleID(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestApplySamplingKeepsErrorsAndSlowRequests(t *testing.T) {
+	Configure(Configuration{
+		RouteSampleRates:     []RouteSampleRate{{Paths: []string{"/**"}, Rate: 0}},
+		SampleKeepSlowerThan: time.Second,
+	})
+	defer Configure(Configuration{})
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+
+	rate, keep := applySampling(r, http.StatusOK, time.Millisecond, NewErrorProvider())
+	assert.False(t, keep)
+	assert.Equal(t, 0.0, rate)
+
+	for _, status := range []int{http.StatusNotFound, http.StatusBadGateway} {
+		rate, keep = applySampling(r, status, time.Millisecond, NewErrorProvider())
+		assert.True(t, keep, status)
+		assert.Equal(t, 1.0, rate, status)
+	}
+
+	rate, keep = applySampling(r, http.StatusOK, 2*time.Second, NewErrorProvider())
+	assert.True(t, keep)
+	assert.Equal(t, 1.0, rate)
+
+	errorProvider := NewErrorProvider()
+	errorProvider.AddCustomError("boom", ServerError, "test")
+	_, keep = applySampling(r, http.StatusOK, time.Millisecond, errorProvider)
+	assert.True(t, keep)
+}
+
+func TestGlobalSampleRateZeroKeepsOnlyErrorsAndSlowRequests(t *testing.T) {
+	zero := 0.0
+	Configure(Configuration{SampleRate: &zero, SampleKeepSlowerThan: time.Second})
+	defer Configure(Configuration{})
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	_, keep := applySampling(r, http.StatusOK, time.Millisecond, NewErrorProvider())
+	assert.False(t, keep)
+	_, keep = applySampling(r, http.StatusInternalServerError, time.Millisecond, NewErrorProvider())
+	assert.True(t, keep)
+	_, keep = applySampling(r, http.StatusOK, 2*time.Second, NewErrorProvider())
+	assert.True(t, keep)
+}
+
+func TestSampledOutBodiesAreNotDecoded(t *testing.T) {
+	var decoded atomic.Int32
+	RegisterContentDecoder("x-counted", func(r io.Reader) (io.ReadCloser, error) {
+		decoded.Add(1)
+		return io.NopCloser(r), nil
+	})
+	defer func() {
+		contentDecodersMu.Lock()
+		delete(contentDecoders, "x-counted")
+		contentDecodersMu.Unlock()
+	}()
+
+	zero := 0.0
+	sender := &MemorySender{}
+	Configure(Configuration{API_KEY: "test-api-key", Sender: sender, SampleRate: &zero})
+	defer Configure(Configuration{})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Content-Encoding", "x-counted")
+		w.Write([]byte("not json"))
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("not json"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "x-counted")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// Neither decoded nor kept for the errors decoding would raise
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), decoded.Load())
+	assert.Empty(t, sender.Payloads())
+}
+
+func TestMiddlewareSampling(t *testing.T) {
+	received := make(chan MetaData, 4)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	half := 0.5
+	Configure(Configuration{
+		SDK_TOKEN:        "test-sdk-token",
+		API_KEY:          "test-api-key",
+		Endpoint:         treblleServer.URL,
+		SampleRate:       &half,
+		RouteSampleRates: []RouteSampleRate{{Paths: []string{"/noisy"}, Rate: 0}},
+	})
+	defer Configure(Configuration{})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Find a request ID inside the 50% sample
+	var id string
+	for i := 0; id == ""; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-ID", fmt.Sprintf("request-%d", i))
+		if sampleRequest(r, 0.5) {
+			id = r.Header.Get("X-Request-ID")
+		}
+	}
+
+	for _, target := range []string{"/noisy", "/noisy?fail=1", "/sampled"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-Request-ID", id)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	rates := make(map[string]float64)
+	for i := 0; i < 2; i++ {
+		select {
+		case meta := <-received:
+			rates[meta.Data.Request.RoutePath] = meta.Data.Request.SampleRate
+			if meta.Data.Request.RoutePath == "/noisy" {
+				require.Equal(t, 500, meta.Data.Response.Code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for Treblle payload")
+		}
+	}
+	assert.Equal(t, map[string]float64{"/noisy": 1, "/sampled": 0.5}, rates)
+
+	select {
+	case meta := <-received:
+		t.Fatalf("unexpected payload for %s", meta.Data.Request.Url)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
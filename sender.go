@@ -0,0 +1,313 @@
+package treblle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sender delivers payloads. Middleware, the AsyncProcessor, the
+// BatchErrorCollector and Shutdown all send through Configuration.Sender.
+type Sender interface {
+	Send(ctx context.Context, payload MetaData) error
+}
+
+// SenderFunc adapts a function to the Sender interface
+type SenderFunc func(ctx context.Context, payload MetaData) error
+
+// Send calls f(ctx, payload)
+func (f SenderFunc) Send(ctx context.Context, payload MetaData) error {
+	return f(ctx, payload)
+}
+
+// defaultHTTPClient delivers payloads until Configure builds the configured client
+var defaultHTTPClient = &http.Client{}
+
+// HTTPSender posts payloads as JSON to the Treblle API. It is the default
+// Sender. Payloads failing with a network error, 429 or 5xx are retried with
+// backoff until the send timeout, failing over to the other endpoints in turn.
+type HTTPSender struct {
+	Endpoint string       // URL payloads are posted to (default: Configuration.Endpoint, or the Treblle endpoints)
+	APIKey   string       // Value of the x-api-key header (default: Configuration.SDK_TOKEN)
+	Client   *http.Client // Client sending the requests (default: the client built from the Configuration)
+
+	gzipRejected sync.Map // Endpoints that refused gzipped payloads, sent plain JSON from then on
+}
+
+// Send posts payload, retrying it as configured, and returns the error of
+// the last attempt
+func (s *HTTPSender) Send(ctx context.Context, payload MetaData) error {
+	bytesRepresentation, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// Print debug info if debug mode is enabled
+	if Config.Debug {
+		prettyJson, _ := json.MarshalIndent(payload, "", "  ")
+		fmt.Println("\n==== DEBUG: TREBLLE PAYLOAD ====")
+		fmt.Println(string(prettyJson))
+		fmt.Println("=================================")
+
+		// Highlight the critical fields used for endpoint grouping
+		fmt.Println("\n🔍 Important fields for endpoint grouping:")
+		fmt.Printf("Request 'url' field: %s\n", payload.Data.Request.Url)
+		fmt.Printf("Request 'route_path' field: %s\n", payload.Data.Request.RoutePath)
+		fmt.Println("=================================")
+	}
+
+	return s.deliver(ctx, s.endpoints(), bytesRepresentation, "application/json")
+}
+
+// endpoints returns the endpoints payloads are posted to, in failover order
+func (s *HTTPSender) endpoints() []string {
+	if s.Endpoint != "" {
+		return []string{s.Endpoint}
+	}
+	return getTreblleBaseUrls()
+}
+
+// deliver posts body to endpoints in turn, compressed when large enough,
+// retrying it as configured
+func (s *HTTPSender) deliver(ctx context.Context, endpoints []string, body []byte, contentType string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sendTimeout())
+		defer cancel()
+	}
+
+	compressed := compressPayload(body)
+
+	// Every attempt carries the same key, so a payload the API received
+	// before the attempt failed is not counted twice
+	idempotencyKey := payloadIdempotencyKey(ctx)
+
+	for attempt := 0; ; attempt++ {
+		endpoint := endpoints[attempt%len(endpoints)]
+
+		var err error
+		if _, rejected := s.gzipRejected.Load(endpoint); compressed != nil && !rejected {
+			err = s.post(ctx, endpoint, idempotencyKey, compressed, contentType, "gzip")
+			if isGzipRejected(err) {
+				if Config.Debug {
+					fmt.Printf("%s refused a gzipped payload, sending plain JSON: %v\n", endpoint, err)
+				}
+				err = s.post(ctx, endpoint, idempotencyKey, body, contentType, "")
+				// Only blame compression when the plain payload is not refused too
+				if !isGzipRejected(err) {
+					s.gzipRejected.Store(endpoint, true)
+				}
+			}
+		} else {
+			err = s.post(ctx, endpoint, idempotencyKey, body, contentType, "")
+		}
+		if err == nil {
+			return nil
+		}
+
+		failure, ok := err.(*sendError)
+		if !ok || !failure.retryable || attempt >= Config.MaxSendRetries {
+			return err
+		}
+
+		delay := retryBackoff(attempt)
+		if failure.retryAfter > delay {
+			delay = failure.retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		if Config.Debug {
+			fmt.Printf("Retrying payload in %s after: %v\n", delay, err)
+		}
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+		telemetry.retries.Add(1)
+	}
+}
+
+// post makes one attempt at posting a payload to endpoint, compressed with
+// contentEncoding when set
+func (s *HTTPSender) post(ctx context.Context, endpoint, idempotencyKey string, body []byte, contentType, contentEncoding string) error {
+	apiKey := s.APIKey
+	if apiKey == "" {
+		apiKey = Config.APIKey
+	}
+	client := s.Client
+	if client == nil {
+		client = Config.httpClient
+	}
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	// Print debug info if debug mode is enabled
+	if Config.Debug {
+		fmt.Printf("\n==== DEBUG: TREBLLE ENDPOINT ====\n")
+		fmt.Printf("Sending to: %s\n", endpoint)
+		fmt.Printf("================================\n")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Network errors are retried unless the payload ran out of time
+		return &sendError{err: err, retryable: ctx.Err() == nil}
+	}
+	defer resp.Body.Close()
+
+	if Config.Debug {
+		fmt.Printf("\n==== DEBUG: TREBLLE RESPONSE ====\n")
+		fmt.Printf("Status: %s\n", resp.Status)
+
+		// Read and log response body
+		respBody := make([]byte, 1024)
+		n, _ := resp.Body.Read(respBody)
+		if n > 0 {
+			fmt.Printf("Response: %s\n", respBody[:n])
+		}
+		fmt.Printf("================================\n")
+	}
+
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		failure := &sendError{
+			err:       fmt.Errorf("treblle api returned error status: %s", resp.Status),
+			status:    resp.StatusCode,
+			retryable: isRetryableStatus(resp.StatusCode),
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			failure.retryAfter, _ = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return failure
+	}
+
+	return nil
+}
+
+// StdoutSender writes each payload as JSON, one per line or indented
+type StdoutSender struct {
+	Pretty bool      // Indent payloads instead of writing one per line
+	Writer io.Writer // Where payloads are written (default: os.Stdout)
+
+	mu sync.Mutex
+}
+
+// Send writes payload
+func (s *StdoutSender) Send(ctx context.Context, payload MetaData) error {
+	var (
+		data []byte
+		err  error
+	)
+	if s.Pretty {
+		data, err = json.MarshalIndent(payload, "", "  ")
+	} else {
+		data, err = json.Marshal(payload)
+	}
+	if err != nil {
+		return err
+	}
+
+	writer := s.Writer
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
+
+// JSONLFileSender appends each payload to a file as one line of JSON
+type JSONLFileSender struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJSONLFileSender opens path for appending, creating it when missing
+func NewJSONLFileSender(path string) (*JSONLFileSender, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLFileSender{file: file}, nil
+}
+
+// Send appends payload to the file
+func (s *JSONLFileSender) Send(ctx context.Context, payload MetaData) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file, later sends fail
+func (s *JSONLFileSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// MemorySender records payloads in memory, e.g. for tests
+type MemorySender struct {
+	mu       sync.Mutex
+	payloads []MetaData
+}
+
+// Send records payload
+func (s *MemorySender) Send(ctx context.Context, payload MetaData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, payload)
+	return nil
+}
+
+// Payloads returns a copy of the payloads recorded so far
+func (s *MemorySender) Payloads() []MetaData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payloads := make([]MetaData, len(s.payloads))
+	copy(payloads, s.payloads)
+	return payloads
+}
+
+// Reset forgets the recorded payloads
+func (s *MemorySender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = nil
+}
@@ -0,0 +1,144 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSender(t *testing.T) {
+	Configure(Configuration{SDK_TOKEN: "sdk-token"})
+	defer Configure(Configuration{})
+
+	var (
+		apiKey  string
+		payload MetaData
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey = r.Header.Get("x-api-key")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &payload)
+		if payload.ProjectID == "fail" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	sender := &HTTPSender{Endpoint: server.URL}
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "project"}))
+	assert.Equal(t, "sdk-token", apiKey)
+	assert.Equal(t, "project", payload.ProjectID)
+
+	sender.APIKey = "other-token"
+	assert.Error(t, sender.Send(context.Background(), MetaData{ProjectID: "fail"}))
+	assert.Equal(t, "other-token", apiKey)
+}
+
+func TestStdoutSender(t *testing.T) {
+	var out bytes.Buffer
+	sender := &StdoutSender{Writer: &out}
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "one"}))
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "two"}))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"project_id":"two"`)
+
+	out.Reset()
+	sender.Pretty = true
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "pretty"}))
+	assert.Contains(t, out.String(), "\n  \"project_id\": \"pretty\"")
+}
+
+func TestJSONLFileSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payloads.jsonl")
+	sender, err := NewJSONLFileSender(path)
+	require.NoError(t, err)
+
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "one"}))
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "two"}))
+	require.NoError(t, sender.Close())
+	assert.Error(t, sender.Send(context.Background(), MetaData{}))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var projects []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var payload MetaData
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &payload))
+		projects = append(projects, payload.ProjectID)
+	}
+	assert.Equal(t, []string{"one", "two"}, projects)
+}
+
+func TestMiddlewareUsesConfiguredSender(t *testing.T) {
+	sender := &MemorySender{}
+	Configure(Configuration{API_KEY: "project", Sender: sender})
+	defer Configure(Configuration{})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users", nil))
+
+	require.Eventually(t, func() bool { return len(sender.Payloads()) == 1 }, time.Second, 10*time.Millisecond)
+	payload := sender.Payloads()[0]
+	assert.Equal(t, "project", payload.ProjectID)
+	assert.Equal(t, http.StatusCreated, payload.Data.Response.Code)
+
+	sender.Reset()
+	assert.Empty(t, sender.Payloads())
+}
+
+func TestShutdownAndBatchErrorsUseConfiguredSender(t *testing.T) {
+	sender := &MemorySender{}
+	Configure(Configuration{Sender: sender})
+	defer Configure(Configuration{})
+
+	ShutdownWithCustomData(RequestInfo{Url: "/shutdown"}, ResponseInfo{Code: http.StatusOK}, nil)
+	require.Len(t, sender.Payloads(), 1)
+	assert.Equal(t, "/shutdown", sender.Payloads()[0].Data.Request.Url)
+
+	collector := NewBatchErrorCollector(10, time.Hour)
+	collector.Add(ErrorInfo{Message: "batched"})
+	collector.Close()
+	require.Len(t, sender.Payloads(), 2)
+	assert.Equal(t, "batched", sender.Payloads()[1].Data.Errors[0].Message)
+}
+
+func TestAsyncProcessorUsesConfiguredSender(t *testing.T) {
+	sender := &MemorySender{}
+	Configure(Configuration{Sender: sender})
+	defer Configure(Configuration{})
+
+	processor := NewAsyncProcessor(1)
+	processor.Process(RequestInfo{Url: "/async"}, ResponseInfo{}, NewErrorProvider())
+	require.True(t, processor.Wait(time.Second))
+	require.Len(t, sender.Payloads(), 1)
+	assert.Equal(t, "/async", sender.Payloads()[0].Data.Request.Url)
+}
+
+func TestSenderFunc(t *testing.T) {
+	var called bool
+	var sender Sender = SenderFunc(func(ctx context.Context, payload MetaData) error {
+		called = payload.ProjectID == "project"
+		return nil
+	})
+	require.NoError(t, sender.Send(context.Background(), MetaData{ProjectID: "project"}))
+	assert.True(t, called)
+}
@@ -54,14 +54,7 @@ func Shutdown(r *http.Request, w http.ResponseWriter, responseBody []byte, optio
 	}
 	
 	// Process headers for response info
-	headers := make(map[string]interface{})
-	for key, values := range w.Header() {
-		if len(values) > 0 {
-			headers[key] = values[0]
-		}
-	}
-	
-	headersJson, err := json.Marshal(maskMap(headers))
+	headersJson, err := getMaskedHeaders(w.Header())
 	if err != nil {
 		errorProvider.AddError(err, MarshalError, "header_encoding")
 	}
@@ -119,6 +112,7 @@ func Shutdown(r *http.Request, w http.ResponseWriter, responseBody []byte, optio
 	
 	// Send data to Treblle synchronously (not in a goroutine since we're shutting down)
 	sendToTreblle(ti)
+	flushSender(Config.Sender)
 }
 
 // ShutdownWithCustomData sends custom request and response data to Treblle before shutdown
@@ -149,6 +143,7 @@ func ShutdownWithCustomData(requestInfo RequestInfo, responseInfo ResponseInfo,
 	
 	// Send data to Treblle synchronously
 	sendToTreblle(ti)
+	flushSender(Config.Sender)
 }
 
 // GracefulShutdown flushes any pending batch errors and ensures all data is sent to Treblle
@@ -166,5 +161,9 @@ func GracefulShutdown() {
 	// Flush batch errors if enabled
 	if Config.batchErrorCollector != nil {
 		Config.batchErrorCollector.Flush()
+		Config.batchErrorCollector.wg.Wait()
 	}
+
+	// Send the payloads a batching sender still holds
+	flushSender(Config.Sender)
 }
@@ -0,0 +1,534 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSpoolMaxBytes      = 100 << 20
+	defaultSpoolMaxAge        = 24 * time.Hour
+	defaultSpoolSegmentSize   = 4 << 20
+	defaultSpoolRetryInterval = 30 * time.Second
+
+	spoolSegmentExt = ".spool"
+)
+
+// errSpoolClosed stops a replay when the spool is closed
+var errSpoolClosed = errors.New("treblle spool closed")
+
+// spool keeps payloads that could not be delivered in append-only segment
+// files and replays them in the background. Each record is a line holding
+// a CRC-32, the idempotency key the payload was sent under, if any, and the
+// payload, so a torn or corrupted record only loses itself.
+type spool struct {
+	dir           string
+	maxBytes      int64
+	maxAge        time.Duration
+	segmentSize   int64
+	retryInterval time.Duration
+
+	mu       sync.Mutex
+	file     *os.File // Segment being appended to
+	fileSize int64
+	pending  atomic.Bool // Segments may be waiting for replay
+
+	draining sync.Mutex // Held while replaying, so records are only replayed once
+	wake     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	written   atomic.Uint64
+	replayed  atomic.Uint64
+	corrupted atomic.Uint64
+	evicted   atomic.Uint64
+}
+
+// openSpool opens the spool in dir and starts replaying what a previous
+// process left in it
+func openSpool(config Configuration) (*spool, error) {
+	if err := os.MkdirAll(config.SpoolDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:           config.SpoolDir,
+		maxBytes:      config.SpoolMaxBytes,
+		maxAge:        config.SpoolMaxAge,
+		segmentSize:   config.SpoolSegmentSize,
+		retryInterval: config.SpoolRetryInterval,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultSpoolMaxBytes
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultSpoolMaxAge
+	}
+	if s.segmentSize <= 0 {
+		s.segmentSize = defaultSpoolSegmentSize
+	}
+	if s.retryInterval <= 0 {
+		s.retryInterval = defaultSpoolRetryInterval
+	}
+
+	s.pending.Store(true)
+	s.notify()
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// isSpoolable reports whether a failed payload may be delivered later:
+// anything but a payload the endpoint refused outright
+func isSpoolable(err error) bool {
+	var failure *sendError
+	if errors.As(err, &failure) {
+		return failure.retryable || errors.Is(failure.err, context.DeadlineExceeded) || errors.Is(failure.err, context.Canceled)
+	}
+	return err != nil
+}
+
+// spooledPayload is a spooled payload with the idempotency key it was last
+// sent under, empty when it never was
+type spooledPayload struct {
+	key     string
+	payload json.RawMessage
+}
+
+// spoolFailed stores payloads whose delivery under key failed with err in
+// the configured spool. It reports whether they were stored.
+func spoolFailed(err error, key string, payloads ...json.RawMessage) bool {
+	if Config.spool == nil || !isSpoolable(err) {
+		return false
+	}
+	records := make([]spooledPayload, len(payloads))
+	for i, payload := range payloads {
+		records[i] = spooledPayload{key: key, payload: payload}
+	}
+	if spoolErr := Config.spool.append(records...); spoolErr != nil {
+		if Config.Debug {
+			fmt.Printf("Failed to spool payloads: %v\n", spoolErr)
+		}
+		return false
+	}
+	if Config.Debug {
+		fmt.Printf("Spooled %d payloads after: %v\n", len(payloads), err)
+	}
+	return true
+}
+
+// spoolPayloads stores payloads dropped before delivery in the configured
+// spool. It reports whether they were stored.
+func spoolPayloads(payloads ...MetaData) bool {
+	if Config.spool == nil || len(payloads) == 0 {
+		return false
+	}
+	records := make([]spooledPayload, 0, len(payloads))
+	for _, payload := range payloads {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+		records = append(records, spooledPayload{payload: data})
+	}
+	return Config.spool.append(records...) == nil
+}
+
+// append writes records to the current segment, starting a new one once
+// it is full
+func (s *spool) append(records ...spooledPayload) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		writeSpoolRecord(&buf, record)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil || s.fileSize >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(buf.Bytes())
+	s.fileSize += int64(n)
+	if err != nil {
+		return err
+	}
+	s.written.Add(uint64(len(records)))
+	s.pending.Store(true)
+	return nil
+}
+
+// rotate closes the current segment and starts a new one. Callers hold mu.
+func (s *spool) rotate() error {
+	s.seal()
+	s.enforceRetention()
+
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolSegmentExt))
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.fileSize = 0
+	return nil
+}
+
+// seal closes the current segment, so it can be replayed. Callers hold mu.
+func (s *spool) seal() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+		s.fileSize = 0
+	}
+}
+
+// segments returns the sealed segment files, oldest first. Callers hold mu.
+func (s *spool) segments() []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+
+	var current string
+	if s.file != nil {
+		current = filepath.Base(s.file.Name())
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolSegmentExt) || entry.Name() == current {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(s.dir, name)
+	}
+	return paths
+}
+
+// enforceRetention deletes sealed segments older than maxAge, then the
+// oldest ones until the spool fits in maxBytes. Callers hold mu.
+func (s *spool) enforceRetention() {
+	segments := s.segments()
+	sizes := make([]int64, len(segments))
+	total := s.fileSize
+	for i, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	for i, segment := range segments {
+		if !s.expired(segment) && total <= s.maxBytes {
+			break
+		}
+		records := countRecords(segment)
+		if err := os.Remove(segment); err == nil {
+			total -= sizes[i]
+			s.evicted.Add(uint64(records))
+		}
+	}
+}
+
+// expired reports whether a segment was started more than maxAge ago
+func (s *spool) expired(segment string) bool {
+	started, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(segment), spoolSegmentExt), 10, 64)
+	return err == nil && time.Since(time.Unix(0, started)) > s.maxAge
+}
+
+// countRecords returns the number of records in a segment
+func countRecords(segment string) int {
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(data, []byte{'\n'})
+}
+
+// notify asks the background loop to replay the spool
+func (s *spool) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// delivered tells the spool a payload got through, so it replays what it
+// holds if anything
+func (s *spool) delivered() {
+	if s != nil && s.pending.Load() {
+		s.notify()
+	}
+}
+
+// run replays the spool when woken and periodically while it holds payloads
+func (s *spool) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+			if !s.pending.Load() {
+				continue
+			}
+		case <-s.done:
+			return
+		}
+		s.drain()
+	}
+}
+
+// drain replays the sealed segments, oldest first, stopping at the first
+// payload that still cannot be delivered
+func (s *spool) drain() {
+	s.draining.Lock()
+	defer s.draining.Unlock()
+
+	s.mu.Lock()
+	s.seal()
+	s.enforceRetention()
+	segments := s.segments()
+	s.mu.Unlock()
+
+	if len(segments) == 0 {
+		s.markDrained()
+		return
+	}
+
+	// Replaying probes delivery while the circuit is open
+	err := Config.breaker.guard(func() error {
+		for _, segment := range segments {
+			select {
+			case <-s.done:
+				return errSpoolClosed
+			default:
+			}
+			if err := s.replaySegment(segment); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.markDrained()
+	}
+}
+
+// markDrained clears pending once no segment is left
+func (s *spool) markDrained() {
+	s.mu.Lock()
+	if s.file == nil && len(s.segments()) == 0 {
+		s.pending.Store(false)
+	}
+	s.mu.Unlock()
+}
+
+// replaySegment delivers the records of a segment and deletes it. When
+// delivery fails, the segment is rewritten with the records left and the
+// delivery error is returned.
+func (s *spool) replaySegment(segment string) error {
+	// A segment that cannot be read is left to retention
+	records, err := s.readSegment(segment)
+	if err != nil {
+		if !os.IsNotExist(err) && Config.Debug {
+			fmt.Printf("Failed to read spool segment %s: %v\n", segment, err)
+		}
+		return nil
+	}
+
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = record.key
+	}
+
+	sent, err := replayPayloads(records)
+	s.replayed.Add(uint64(sent))
+	if err == nil {
+		os.Remove(segment)
+		return nil
+	}
+
+	if Config.Debug {
+		fmt.Printf("Spool replay stopped after %d payloads: %v\n", sent, err)
+	}
+	// Keep the keys given to records left, so the next replay reuses them
+	if sent > 0 || keysChanged(keys[sent:], records[sent:]) {
+		s.rewriteSegment(segment, records[sent:])
+	}
+	return err
+}
+
+// keysChanged reports whether records are no longer under keys
+func keysChanged(keys []string, records []spooledPayload) bool {
+	for i, record := range records {
+		if record.key != keys[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// readSegment returns the intact records of a segment, skipping and
+// counting corrupted ones
+func (s *spool) readSegment(segment string) ([]spooledPayload, error) {
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []spooledPayload
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		record, ok := parseSpoolRecord(line)
+		if !ok {
+			s.corrupted.Add(1)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// writeSpoolRecord writes the line of a record. The checksum covers the
+// key and the payload.
+func writeSpoolRecord(buf *bytes.Buffer, record spooledPayload) {
+	content := record.payload
+	if record.key != "" {
+		content = append([]byte(record.key+" "), record.payload...)
+	}
+	fmt.Fprintf(buf, "%08x ", crc32.ChecksumIEEE(content))
+	buf.Write(content)
+	buf.WriteByte('\n')
+}
+
+// parseSpoolRecord checks the checksum of a record line and returns its
+// key and payload. Payloads start with '{', so a line without a key is told
+// apart from one with a key.
+func parseSpoolRecord(line []byte) (spooledPayload, bool) {
+	if len(line) < 10 || line[8] != ' ' {
+		return spooledPayload{}, false
+	}
+	checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return spooledPayload{}, false
+	}
+	content := line[9:]
+	if crc32.ChecksumIEEE(content) != uint32(checksum) {
+		return spooledPayload{}, false
+	}
+
+	var record spooledPayload
+	if content[0] != '{' {
+		key, payload, ok := bytes.Cut(content, []byte{' '})
+		if !ok {
+			return spooledPayload{}, false
+		}
+		record.key, content = string(key), payload
+	}
+	if !json.Valid(content) {
+		return spooledPayload{}, false
+	}
+	record.payload = append(json.RawMessage(nil), content...)
+	return record, true
+}
+
+// rewriteSegment replaces a segment with the records it still holds
+func (s *spool) rewriteSegment(segment string, records []spooledPayload) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		writeSpoolRecord(&buf, record)
+	}
+
+	tmp := segment + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, segment); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// replayPayloads delivers spooled payloads with the configured Sender,
+// returning how many got through before the first failure. Payloads the
+// endpoint refuses outright are skipped rather than replayed forever.
+//
+// Each payload is sent under the idempotency key it was last sent under,
+// so one the API received before its delivery failed is not counted twice.
+// Payloads without a key of their own, never sent or spooled as part of a
+// batch, get a new one, stored in records so a further replay reuses it.
+func replayPayloads(records []spooledPayload) (int, error) {
+	if batcher, ok := Config.Sender.(*BatchSender); ok {
+		return batcher.replay(records)
+	}
+
+	sender := Config.Sender
+	if sender == nil {
+		sender = &HTTPSender{}
+	}
+	shared := make(map[string]int)
+	for _, record := range records {
+		shared[record.key]++
+	}
+	for i := range records {
+		if records[i].key == "" || shared[records[i].key] > 1 {
+			records[i].key = newIdempotencyKey()
+		}
+
+		var payload MetaData
+		if err := json.Unmarshal(records[i].payload, &payload); err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(withIdempotencyKey(context.Background(), records[i].key), sendTimeout())
+		err := sender.Send(ctx, payload)
+		cancel()
+		if err != nil && isSpoolable(err) {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// close stops the background replay and closes the current segment
+func (s *spool) close() {
+	select {
+	case <-s.done:
+		return
+	default:
+		close(s.done)
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seal()
+}
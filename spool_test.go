@@ -0,0 +1,288 @@
+package treblle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakySender records payloads while up and fails while down
+type flakySender struct {
+	MemorySender
+	up atomic.Bool
+}
+
+func (s *flakySender) Send(ctx context.Context, payload MetaData) error {
+	if !s.up.Load() {
+		return errors.New("connection refused")
+	}
+	return s.MemorySender.Send(ctx, payload)
+}
+
+func spoolRecord(payload string) string {
+	return fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(payload)), payload)
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	require.NoError(t, err)
+	return matches
+}
+
+func TestSpoolKeepsFailedPayloadsUntilRecovery(t *testing.T) {
+	dir := t.TempDir()
+	sender := &flakySender{}
+	Configure(Configuration{Sender: sender, SpoolDir: dir, SpoolRetryInterval: 10 * time.Millisecond})
+	defer Configure(Configuration{})
+
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{ProjectID: "one"}))
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{ProjectID: "two"}))
+	assert.Equal(t, uint64(2), Config.spool.written.Load())
+	assert.Len(t, spoolFiles(t, dir), 1)
+
+	// Replay keeps failing while the sender is down
+	time.Sleep(30 * time.Millisecond)
+	assert.Empty(t, sender.Payloads())
+
+	sender.up.Store(true)
+	require.Eventually(t, func() bool { return len(sender.Payloads()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "one", sender.Payloads()[0].ProjectID)
+	assert.Equal(t, "two", sender.Payloads()[1].ProjectID)
+	require.Eventually(t, func() bool { return len(spoolFiles(t, dir)) == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, uint64(2), Config.spool.replayed.Load())
+}
+
+func TestSpoolReplaysPreviousProcessSkippingCorruption(t *testing.T) {
+	dir := t.TempDir()
+	good, _ := json.Marshal(MetaData{ProjectID: "good"})
+	later, _ := json.Marshal(MetaData{ProjectID: "later"})
+	segment := spoolRecord(string(good)) +
+		"garbage\n" +
+		fmt.Sprintf("%08x %s\n", 1234, good) + // Wrong checksum
+		spoolRecord(string(later)) +
+		spoolRecord(string(good))[:20] // Torn write at a crash
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolSegmentExt)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(segment), 0o644))
+
+	sender := &MemorySender{}
+	Configure(Configuration{Sender: sender, SpoolDir: dir})
+	defer Configure(Configuration{})
+
+	require.Eventually(t, func() bool { return len(spoolFiles(t, dir)) == 0 }, time.Second, 5*time.Millisecond)
+	require.Len(t, sender.Payloads(), 2)
+	assert.Equal(t, "good", sender.Payloads()[0].ProjectID)
+	assert.Equal(t, "later", sender.Payloads()[1].ProjectID)
+	assert.Equal(t, uint64(3), Config.spool.corrupted.Load())
+}
+
+func TestSpoolRewritesPartiallyReplayedSegments(t *testing.T) {
+	dir := t.TempDir()
+	var sent atomic.Int32
+	Configure(Configuration{
+		SpoolDir:           dir,
+		SpoolRetryInterval: time.Hour,
+		Sender: SenderFunc(func(ctx context.Context, payload MetaData) error {
+			if payload.ProjectID == "blocked" {
+				return errors.New("timeout")
+			}
+			sent.Add(1)
+			return nil
+		}),
+	})
+	defer Configure(Configuration{})
+
+	require.NoError(t, Config.spool.append(
+		spooledPayload{payload: json.RawMessage(`{"project_id":"first"}`)},
+		spooledPayload{payload: json.RawMessage(`{"project_id":"blocked"}`)},
+		spooledPayload{payload: json.RawMessage(`{"project_id":"last"}`)},
+	))
+	Config.spool.drain()
+	assert.Equal(t, int32(1), sent.Load())
+
+	files := spoolFiles(t, dir)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+	assert.NotContains(t, string(data), "first")
+}
+
+func TestSpoolRetention(t *testing.T) {
+	dir := t.TempDir()
+	record := spoolRecord(`{"project_id":"old"}`)
+	old := fmt.Sprintf("%020d%s", time.Now().Add(-2*time.Hour).UnixNano(), spoolSegmentExt)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, old), []byte(record), 0o644))
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("%020d%s", time.Now().Add(time.Duration(i)*time.Millisecond).UnixNano(), spoolSegmentExt)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat(record, 10)), 0o644))
+	}
+
+	s := &spool{dir: dir, maxAge: time.Hour, maxBytes: int64(len(record) * 25)}
+	s.enforceRetention()
+
+	// The expired segment goes, then the oldest until the rest fits
+	assert.Len(t, spoolFiles(t, dir), 2)
+	assert.Equal(t, uint64(11), s.evicted.Load())
+}
+
+func TestSpoolIgnoresRefusedPayloads(t *testing.T) {
+	assert.False(t, isSpoolable(&sendError{err: errors.New("400 Bad Request"), status: 400}))
+	assert.True(t, isSpoolable(&sendError{err: errors.New("503"), status: 503, retryable: true}))
+	assert.True(t, isSpoolable(&sendError{err: fmt.Errorf("post: %w", context.DeadlineExceeded)}))
+	assert.True(t, isSpoolable(errors.New("custom sender failure")))
+	assert.False(t, isSpoolable(nil))
+}
+
+func TestSpoolKeepsPayloadsDroppedFromTheQueue(t *testing.T) {
+	dir := t.TempDir()
+	processor, _ := startBusyProcessor(t, Configuration{AsyncQueueSize: 1, SpoolDir: dir, SpoolRetryInterval: time.Hour})
+
+	processor.Process(RequestInfo{Url: "/queued"}, ResponseInfo{}, nil)
+	processor.Process(RequestInfo{Url: "/overflow"}, ResponseInfo{}, nil)
+	assert.Equal(t, uint64(1), processor.Stats().DroppedNewest)
+	assert.Equal(t, uint64(1), Config.spool.written.Load())
+
+	// What is left at shutdown is kept for the next process
+	processor.Shutdown(10 * time.Millisecond)
+	require.Eventually(t, func() bool { return Config.spool.written.Load() == 3 }, time.Second, 5*time.Millisecond)
+}
+
+func TestSpoolReplaysUnderTheFirstIdempotencyKey(t *testing.T) {
+	server := newRecordingServer(nil, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer server.Close()
+	Configure(Configuration{
+		Sender:             &HTTPSender{Endpoint: server.URL},
+		MaxSendRetries:     -1,
+		SpoolDir:           t.TempDir(),
+		SpoolRetryInterval: time.Hour,
+	})
+	defer Configure(Configuration{})
+
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{ProjectID: "one"}))
+	require.Equal(t, uint64(1), Config.spool.written.Load())
+
+	// A replay failing again keeps the key for the next one
+	Config.spool.drain()
+	Config.spool.drain()
+	keys := server.attempts()
+	require.Len(t, keys, 3)
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+	assert.Equal(t, uint64(1), Config.spool.replayed.Load())
+}
+
+func TestSpoolReplaysDroppedPayloadsUnderOneIdempotencyKey(t *testing.T) {
+	server := newRecordingServer(nil, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer server.Close()
+	Configure(Configuration{
+		Sender:             &HTTPSender{Endpoint: server.URL},
+		MaxSendRetries:     -1,
+		SpoolDir:           t.TempDir(),
+		SpoolRetryInterval: time.Hour,
+	})
+	defer Configure(Configuration{})
+
+	// Payloads dropped before delivery are spooled without a key
+	require.True(t, spoolPayloads(MetaData{ProjectID: "one"}))
+
+	Config.spool.drain()
+	Config.spool.drain()
+	Config.spool.drain()
+	keys := server.attempts()
+	require.Len(t, keys, 3)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+	assert.Equal(t, uint64(1), Config.spool.replayed.Load())
+}
+
+func TestSpoolReplaysBatchesUnderTheirIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	var bodies []string
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	Configure(Configuration{
+		PayloadBatchingEnabled: true,
+		PayloadBatchEndpoint:   server.URL,
+		PayloadBatchSize:       2,
+		PayloadBatchLinger:     time.Hour,
+		MaxSendRetries:         -1,
+		SpoolDir:               t.TempDir(),
+		SpoolRetryInterval:     time.Hour,
+	})
+	defer Configure(Configuration{})
+
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{ProjectID: "one"}))
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{ProjectID: "two"}))
+	require.Equal(t, uint64(2), Config.spool.written.Load())
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	Config.spool.drain()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, keys, 2)
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.Equal(t, uint64(2), Config.spool.replayed.Load())
+}
+
+func TestParseSpoolRecord(t *testing.T) {
+	var buf bytes.Buffer
+	writeSpoolRecord(&buf, spooledPayload{key: "abc", payload: json.RawMessage(`{"project_id":"keyed"}`)})
+	record, ok := parseSpoolRecord(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	require.True(t, ok)
+	assert.Equal(t, spooledPayload{key: "abc", payload: json.RawMessage(`{"project_id":"keyed"}`)}, record)
+
+	// Records of payloads never sent have no key
+	record, ok = parseSpoolRecord([]byte(strings.TrimSuffix(spoolRecord(`{"project_id":"plain"}`), "\n")))
+	require.True(t, ok)
+	assert.Equal(t, spooledPayload{payload: json.RawMessage(`{"project_id":"plain"}`)}, record)
+
+	// The checksum covers the key
+	tampered := bytes.Replace(buf.Bytes(), []byte("abc"), []byte("abd"), 1)
+	_, ok = parseSpoolRecord(bytes.TrimSuffix(tampered, []byte("\n")))
+	assert.False(t, ok)
+}
+
+func TestAsyncProcessorCountsSpooledPayloads(t *testing.T) {
+	Configure(Configuration{Sender: &flakySender{}, SpoolDir: t.TempDir(), SpoolRetryInterval: time.Hour})
+	defer Configure(Configuration{})
+
+	processor := NewAsyncProcessor(1)
+	defer processor.Shutdown(time.Second)
+	processor.Process(RequestInfo{}, ResponseInfo{}, nil)
+	require.True(t, processor.Wait(time.Second))
+
+	stats := processor.Stats()
+	assert.Equal(t, uint64(1), stats.Spooled)
+	assert.Zero(t, stats.Sent)
+	assert.Zero(t, stats.Failed)
+}
@@ -0,0 +1,206 @@
+package treblle
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// SSEEndClientDisconnect is reported when the client went away before the handler returned
+	SSEEndClientDisconnect = "client_disconnect"
+	// SSEEndServerClose is reported when the handler finished the stream itself
+	SSEEndServerClose = "server_close"
+
+	// maxSSELineSize bounds the memory used for a single unterminated line
+	maxSSELineSize = 64 * 1024
+)
+
+// SSESessionInfo summarises a Server-Sent Events response
+type SSESessionInfo struct {
+	TimeToFirstEvent float64        `json:"time_to_first_event,omitempty"` // Milliseconds from request start to first event
+	EventCount       int            `json:"event_count"`
+	EventTypes       map[string]int `json:"event_types"`
+	Bytes            int64          `json:"bytes"`
+	Duration         float64        `json:"duration"` // Milliseconds the stream was open
+	EndReason        string         `json:"end_reason"`
+}
+
+// sseEvent is a captured event as reported in the response body
+type sseEvent struct {
+	Event string      `json:"event"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// sseTracker parses an event stream as it is written to the client
+type sseTracker struct {
+	openedAt     time.Time
+	firstEventAt time.Time
+	closedAt     time.Time
+	count        int
+	types        map[string]int
+	bytes        int64
+	endReason    string
+
+	captureLimit int
+	captured     []sseEvent
+
+	line      []byte
+	eventType string
+	eventID   string
+	data      strings.Builder
+	hasData   bool
+}
+
+// isEventStream reports whether the response headers declare an SSE stream
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+func newSSETracker(captureLimit int) *sseTracker {
+	return &sseTracker{
+		openedAt:     time.Now(),
+		types:        make(map[string]int),
+		captureLimit: captureLimit,
+	}
+}
+
+// write feeds a chunk of the stream to the parser
+func (t *sseTracker) write(b []byte) {
+	t.bytes += int64(len(b))
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			t.appendLine(b)
+			return
+		}
+		t.appendLine(b[:i])
+		t.processLine(bytes.TrimSuffix(t.line, []byte("\r")))
+		t.line = t.line[:0]
+		b = b[i+1:]
+	}
+}
+
+func (t *sseTracker) appendLine(b []byte) {
+	if room := maxSSELineSize - len(t.line); len(b) > room {
+		b = b[:room]
+	}
+	t.line = append(t.line, b...)
+}
+
+// processLine applies a single line following the SSE parsing rules
+func (t *sseTracker) processLine(line []byte) {
+	if len(line) == 0 {
+		t.dispatch()
+		return
+	}
+	if line[0] == ':' {
+		return // Comment or keep-alive
+	}
+
+	field, value := string(line), ""
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field = string(line[:i])
+		value = strings.TrimPrefix(string(line[i+1:]), " ")
+	}
+
+	switch field {
+	case "event":
+		t.eventType = value
+	case "id":
+		t.eventID = value
+	case "data":
+		if t.hasData {
+			t.data.WriteByte('\n')
+		}
+		t.data.WriteString(value)
+		t.hasData = true
+	}
+}
+
+// dispatch completes the pending event, if any
+func (t *sseTracker) dispatch() {
+	defer func() {
+		t.eventType = ""
+		t.data.Reset()
+		t.hasData = false
+	}()
+	if !t.hasData {
+		return
+	}
+
+	eventType := t.eventType
+	if eventType == "" {
+		eventType = "message"
+	}
+
+	if t.count == 0 {
+		t.firstEventAt = time.Now()
+	}
+	t.count++
+	t.types[eventType]++
+
+	if len(t.captured) < t.captureLimit {
+		t.captured = append(t.captured, sseEvent{
+			Event: eventType,
+			ID:    t.eventID,
+			Data:  maskEventData(t.data.String()),
+		})
+	}
+}
+
+// close marks the end of the stream
+func (t *sseTracker) close(clientGone bool) {
+	if !t.closedAt.IsZero() {
+		return
+	}
+	t.closedAt = time.Now()
+	t.endReason = SSEEndServerClose
+	if clientGone {
+		t.endReason = SSEEndClientDisconnect
+	}
+}
+
+// session returns the summary of the stream relative to the request start time
+func (t *sseTracker) session(startTime time.Time) *SSESessionInfo {
+	t.close(false)
+
+	info := &SSESessionInfo{
+		EventCount: t.count,
+		EventTypes: t.types,
+		Bytes:      t.bytes,
+		Duration:   float64(t.closedAt.Sub(t.openedAt).Microseconds()) / 1000.0,
+		EndReason:  t.endReason,
+	}
+	if !t.firstEventAt.IsZero() {
+		info.TimeToFirstEvent = float64(t.firstEventAt.Sub(startTime).Microseconds()) / 1000.0
+	}
+	return info
+}
+
+// body returns the captured events as a JSON array, or an empty object when
+// capturing is disabled
+func (t *sseTracker) body() (json.RawMessage, error) {
+	if t.captureLimit <= 0 {
+		return json.RawMessage("{}"), nil
+	}
+	events := t.captured
+	if events == nil {
+		events = []sseEvent{}
+	}
+	return json.Marshal(events)
+}
+
+// maskEventData masks JSON event payloads; other payloads are kept as strings
+func maskEventData(data string) interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil {
+		return data
+	}
+	return maskData(decoded)
+}
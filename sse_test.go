@@ -0,0 +1,97 @@
+package treblle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSETrackerParsing(t *testing.T) {
+	Configure(Configuration{
+		DefaultFieldsToMask: []string{"password"},
+	})
+
+	tracker := newSSETracker(2)
+	// Events split across writes, with comments, CRLF line endings and a
+	// multi-line data field
+	tracker.write([]byte(": keep-alive\n\nevent: login\nid: 1\ndata: {\"user\":\"bob\","))
+	tracker.write([]byte("\"password\":\"secret\"}\n\r\n"))
+	tracker.write([]byte("data: line one\ndata: line two\n\n"))
+	tracker.write([]byte("event: login\ndata: again\n\n"))
+	tracker.close(false)
+
+	session := tracker.session(tracker.openedAt)
+	assert.Equal(t, 3, session.EventCount)
+	assert.Equal(t, map[string]int{"login": 2, "message": 1}, session.EventTypes)
+	assert.Equal(t, SSEEndServerClose, session.EndReason)
+	assert.Greater(t, session.Bytes, int64(0))
+
+	body, err := tracker.body()
+	require.NoError(t, err)
+
+	var events []map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &events))
+	require.Len(t, events, 2)
+	assert.Equal(t, "login", events[0]["event"])
+	assert.Equal(t, "1", events[0]["id"])
+	assert.Equal(t, map[string]interface{}{"user": "bob", "password": "*********"}, events[0]["data"])
+	assert.Equal(t, "message", events[1]["event"])
+	assert.Equal(t, "line one\nline two", events[1]["data"])
+}
+
+func TestSSETrackerWithoutCapture(t *testing.T) {
+	tracker := newSSETracker(0)
+	tracker.write([]byte("data: hello\n\n"))
+
+	body, err := tracker.body()
+	require.NoError(t, err)
+	assert.Equal(t, json.RawMessage("{}"), body)
+	assert.Equal(t, 1, tracker.session(tracker.openedAt).EventCount)
+}
+
+func TestMiddlewareReportsSSESession(t *testing.T) {
+	received := make(chan MetaData, 1)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	Configure(Configuration{
+		SDK_TOKEN:        "test-sdk-token",
+		API_KEY:          "test-api-key",
+		Endpoint:         treblleServer.URL,
+		SSECaptureEvents: 1,
+	})
+	defer Configure(Configuration{SSECaptureEvents: 0})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Write([]byte("event: tick\ndata: {\"n\":1}\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("event: tick\ndata: {\"n\":2}\n\n"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	select {
+	case meta := <-received:
+		sse := meta.Data.Response.SSE
+		require.NotNil(t, sse)
+		assert.Equal(t, 2, sse.EventCount)
+		assert.Equal(t, map[string]int{"tick": 2}, sse.EventTypes)
+		assert.Equal(t, SSEEndServerClose, sse.EndReason)
+		assert.Equal(t, int64(rec.Body.Len()), sse.Bytes)
+		assert.JSONEq(t, `[{"event":"tick","data":{"n":1}}]`, string(meta.Data.Response.Body))
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Treblle payload")
+	}
+}
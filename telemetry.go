@@ -0,0 +1,257 @@
+package treblle
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sendLatencyBuckets are the upper bounds, in seconds, of the send latency histogram
+var sendLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// overheadBuckets are the upper bounds, in seconds, of the middleware overhead histogram
+var overheadBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05}
+
+// DeliveryStats describes what the SDK did with the requests it saw since
+// the process started. Queue, spool and circuit breaker figures are those
+// of the current configuration.
+type DeliveryStats struct {
+	Captured    uint64              // Requests captured and handed over for delivery
+	SampledOut  uint64              // Requests left out by sampling
+	Queued      int                 // Payloads waiting in the async queue
+	QueuedBytes int64               // Approximate size of the waiting payloads
+	Dropped     DroppedStats        // Payloads dropped before delivery, by reason
+	Sent        uint64              // Payloads delivered
+	Failed      uint64              // Payloads the Sender failed to deliver, retries included
+	Retries     uint64              // HTTP deliveries retried after a network error, 429 or 5xx
+	Spooled     uint64              // Payloads written to the spool
+	Replayed    uint64              // Spooled payloads delivered
+	SendLatency Histogram           // Time taken by deliveries, retries included
+	Overhead    Histogram           // Time the middleware added to each request besides the handler
+	Circuit     CircuitBreakerStats // State of the circuit breaker
+}
+
+// DroppedStats counts payloads dropped before delivery, by reason. Dropped
+// payloads are spooled when a spool is configured.
+type DroppedStats struct {
+	QueueFull      uint64 // Arriving payloads dropped because the async queue was full
+	QueueEvicted   uint64 // Queued payloads evicted for newer ones
+	EnqueueTimeout uint64 // Arriving payloads dropped after waiting for room in the queue
+	Shutdown       uint64 // Payloads arriving after, or still queued at the end of, the async shutdown
+	CircuitOpen    uint64 // Payloads not sent because the circuit was open
+}
+
+// Histogram is a snapshot of durations, in seconds
+type Histogram struct {
+	Buckets []HistogramBucket // Cumulative counts, by increasing upper bound
+	Count   uint64            // Observations
+	Sum     float64           // Sum of the observations
+}
+
+// HistogramBucket counts the observations at most UpperBound seconds long
+type HistogramBucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// histogram counts durations in fixed buckets
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // Per bucket, the last one past every bound
+	count  atomic.Uint64
+	sum    atomic.Int64 // Nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && seconds > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	snapshot := Histogram{
+		Buckets: make([]HistogramBucket, len(h.bounds)),
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()).Seconds(),
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		snapshot.Buckets[i] = HistogramBucket{UpperBound: bound, Count: cumulative}
+	}
+	return snapshot
+}
+
+// telemetryCounters holds the counters of the SDK itself
+type telemetryCounters struct {
+	captured    atomic.Uint64
+	sampledOut  atomic.Uint64
+	sent        atomic.Uint64
+	failed      atomic.Uint64
+	retries     atomic.Uint64
+	circuitOpen atomic.Uint64
+	sendLatency *histogram
+	overhead    *histogram
+}
+
+func newTelemetryCounters() *telemetryCounters {
+	return &telemetryCounters{
+		sendLatency: newHistogram(sendLatencyBuckets),
+		overhead:    newHistogram(overheadBuckets),
+	}
+}
+
+// telemetry holds the counters reported by Stats
+var telemetry = newTelemetryCounters()
+
+// recordDelivery counts the outcome of delivering payloads that took since start
+func (t *telemetryCounters) recordDelivery(payloads int, start time.Time, err error) {
+	if err == ErrCircuitOpen {
+		t.circuitOpen.Add(uint64(payloads))
+		return
+	}
+	t.sendLatency.observe(time.Since(start))
+	if err != nil {
+		t.failed.Add(uint64(payloads))
+	} else {
+		t.sent.Add(uint64(payloads))
+	}
+}
+
+// stats returns the counters, without the queue, spool and circuit breaker figures
+func (t *telemetryCounters) stats() DeliveryStats {
+	return DeliveryStats{
+		Captured:    t.captured.Load(),
+		SampledOut:  t.sampledOut.Load(),
+		Dropped:     DroppedStats{CircuitOpen: t.circuitOpen.Load()},
+		Sent:        t.sent.Load(),
+		Failed:      t.failed.Load(),
+		Retries:     t.retries.Load(),
+		SendLatency: t.sendLatency.snapshot(),
+		Overhead:    t.overhead.snapshot(),
+	}
+}
+
+// Stats returns what the SDK did with the requests it saw
+func Stats() DeliveryStats {
+	stats := telemetry.stats()
+	stats.Circuit = GetCircuitBreakerStats()
+
+	if asyncProcessorStarted.Load() {
+		async := asyncProcessor.Stats()
+		stats.Queued = async.Queued
+		stats.QueuedBytes = async.QueuedBytes
+		stats.Dropped.QueueFull = async.DroppedNewest
+		stats.Dropped.QueueEvicted = async.DroppedOldest
+		stats.Dropped.EnqueueTimeout = async.DroppedTimeout
+		stats.Dropped.Shutdown = async.DroppedShutdown
+	}
+
+	if spool := Config.spool; spool != nil {
+		stats.Spooled = spool.written.Load()
+		stats.Replayed = spool.replayed.Load()
+	}
+	return stats
+}
+
+var expvarOnce sync.Once
+
+// publishExpvar publishes Stats as the "treblle" expvar, unless the
+// application already uses that name
+func publishExpvar() {
+	expvarOnce.Do(func() {
+		if expvar.Get("treblle") != nil {
+			return
+		}
+		expvar.Publish("treblle", expvar.Func(func() any { return Stats() }))
+	})
+}
+
+// MetricsHandler serves Stats in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		writeMetrics(buf, Stats())
+		buf.Flush()
+	})
+}
+
+// writeMetrics writes stats in the Prometheus text format
+func writeMetrics(w io.Writer, stats DeliveryStats) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	counter := func(name, help string, value uint64) {
+		metric(name, "counter", help)
+		fmt.Fprintf(w, "%s %d\n", name, value)
+	}
+	gauge := func(name, help string, value int64) {
+		metric(name, "gauge", help)
+		fmt.Fprintf(w, "%s %d\n", name, value)
+	}
+	histogram := func(name, help string, h Histogram) {
+		metric(name, "histogram", help)
+		for _, bucket := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bucket.UpperBound), bucket.Count)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+		fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.Sum), name, h.Count)
+	}
+
+	counter("treblle_requests_captured_total", "Requests captured and handed over for delivery.", stats.Captured)
+	counter("treblle_requests_sampled_out_total", "Requests left out by sampling.", stats.SampledOut)
+	gauge("treblle_queue_payloads", "Payloads waiting in the async queue.", int64(stats.Queued))
+	gauge("treblle_queue_bytes", "Approximate size of the payloads waiting in the async queue.", stats.QueuedBytes)
+
+	metric("treblle_payloads_dropped_total", "counter", "Payloads dropped before delivery, by reason.")
+	for _, dropped := range []struct {
+		reason string
+		count  uint64
+	}{
+		{"queue_full", stats.Dropped.QueueFull},
+		{"queue_evicted", stats.Dropped.QueueEvicted},
+		{"enqueue_timeout", stats.Dropped.EnqueueTimeout},
+		{"shutdown", stats.Dropped.Shutdown},
+		{"circuit_open", stats.Dropped.CircuitOpen},
+	} {
+		fmt.Fprintf(w, "treblle_payloads_dropped_total{reason=\"%s\"} %d\n", dropped.reason, dropped.count)
+	}
+
+	counter("treblle_payloads_sent_total", "Payloads delivered.", stats.Sent)
+	counter("treblle_payloads_failed_total", "Payloads the sender failed to deliver.", stats.Failed)
+	counter("treblle_send_retries_total", "HTTP deliveries retried.", stats.Retries)
+	counter("treblle_payloads_spooled_total", "Payloads written to the spool.", stats.Spooled)
+	counter("treblle_payloads_replayed_total", "Spooled payloads delivered.", stats.Replayed)
+	histogram("treblle_send_duration_seconds", "Time taken by deliveries, retries included.", stats.SendLatency)
+	histogram("treblle_middleware_overhead_seconds", "Time the middleware added to each request besides the handler.", stats.Overhead)
+
+	metric("treblle_circuit_state", "gauge", "State of the circuit breaker around delivery.")
+	for _, state := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+		value := 0
+		if stats.Circuit.State == state {
+			value = 1
+		}
+		fmt.Fprintf(w, "treblle_circuit_state{state=\"%s\"} %d\n", state, value)
+	}
+	counter("treblle_circuit_opened_total", "Times the circuit breaker opened.", stats.Circuit.Opened)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
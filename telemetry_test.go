@@ -0,0 +1,170 @@
+package treblle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1})
+	h.observe(5 * time.Millisecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(50 * time.Millisecond)
+	h.observe(time.Second)
+
+	snapshot := h.snapshot()
+	assert.Equal(t, []HistogramBucket{{UpperBound: 0.01, Count: 2}, {UpperBound: 0.1, Count: 3}}, snapshot.Buckets)
+	assert.Equal(t, uint64(4), snapshot.Count)
+	assert.InDelta(t, 1.065, snapshot.Sum, 1e-9)
+}
+
+func TestTelemetryCountsDeliveries(t *testing.T) {
+	counters := newTelemetryCounters()
+	start := time.Now().Add(-20 * time.Millisecond)
+
+	counters.recordDelivery(1, start, nil)
+	counters.recordDelivery(3, start, nil)
+	counters.recordDelivery(1, start, errors.New("timeout"))
+	counters.recordDelivery(2, time.Time{}, ErrCircuitOpen)
+
+	stats := counters.stats()
+	assert.Equal(t, uint64(4), stats.Sent)
+	assert.Equal(t, uint64(1), stats.Failed)
+	assert.Equal(t, uint64(2), stats.Dropped.CircuitOpen)
+	// Payloads not sent take no time
+	assert.Equal(t, uint64(3), stats.SendLatency.Count)
+	assert.GreaterOrEqual(t, stats.SendLatency.Sum, 0.06)
+	assert.Equal(t, uint64(0), stats.SendLatency.Buckets[1].Count, "none within 10ms")
+}
+
+// Other tests may still be delivering in the background, so the process-wide
+// counters below are only checked for what these tests add to them at least
+
+func TestStatsCountsDeliveries(t *testing.T) {
+	server := newRecordingServer(nil, http.StatusServiceUnavailable)
+	defer server.Close()
+	Configure(Configuration{Sender: &HTTPSender{Endpoint: server.URL}, RetryBaseDelay: time.Millisecond})
+	defer Configure(Configuration{})
+	before := Stats()
+
+	require.NoError(t, sendToTreblleWithContext(context.Background(), MetaData{}))
+
+	Config.Sender = SenderFunc(func(ctx context.Context, payload MetaData) error { return errors.New("timeout") })
+	require.Error(t, sendToTreblleWithContext(context.Background(), MetaData{}))
+
+	after := Stats()
+	assert.GreaterOrEqual(t, after.Sent-before.Sent, uint64(1))
+	assert.GreaterOrEqual(t, after.Failed-before.Failed, uint64(1))
+	assert.GreaterOrEqual(t, after.Retries-before.Retries, uint64(1))
+	assert.GreaterOrEqual(t, after.SendLatency.Count-before.SendLatency.Count, uint64(2))
+}
+
+func TestStatsCountsCircuitDrops(t *testing.T) {
+	Configure(Configuration{
+		Sender:                SenderFunc(func(ctx context.Context, payload MetaData) error { return errors.New("timeout") }),
+		CircuitBreakerEnabled: true,
+		CircuitMinRequests:    1,
+	})
+	defer Configure(Configuration{})
+	before := Stats()
+
+	sendToTreblleWithContext(context.Background(), MetaData{})
+	sendToTreblleWithContext(context.Background(), MetaData{})
+
+	after := Stats()
+	assert.GreaterOrEqual(t, after.Failed-before.Failed, uint64(1))
+	assert.GreaterOrEqual(t, after.Dropped.CircuitOpen-before.Dropped.CircuitOpen, uint64(1))
+	assert.Equal(t, CircuitOpen, after.Circuit.State)
+}
+
+func TestStatsCountsMiddlewareRequests(t *testing.T) {
+	sender := &MemorySender{}
+	Configure(Configuration{
+		API_KEY:          "test-api-key",
+		Sender:           sender,
+		RouteSampleRates: []RouteSampleRate{{Paths: []string{"/noisy"}, Rate: 0}},
+	})
+	defer Configure(Configuration{})
+	before := Stats()
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, target := range []string{"/noisy", "/orders", "/users"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	require.Eventually(t, func() bool { return len(sender.Payloads()) == 2 }, time.Second, 5*time.Millisecond)
+
+	after := Stats()
+	assert.Equal(t, uint64(2), after.Captured-before.Captured)
+	assert.Equal(t, uint64(1), after.SampledOut-before.SampledOut)
+	assert.Equal(t, uint64(3), after.Overhead.Count-before.Overhead.Count)
+	// The handler's own time is not overhead
+	assert.Less(t, after.Overhead.Sum-before.Overhead.Sum, 0.06)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	Configure(Configuration{})
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE treblle_requests_captured_total counter",
+		`treblle_payloads_dropped_total{reason="queue_full"} `,
+		`treblle_payloads_dropped_total{reason="circuit_open"} `,
+		"# TYPE treblle_send_duration_seconds histogram",
+		`treblle_send_duration_seconds_bucket{le="0.005"} `,
+		`treblle_send_duration_seconds_bucket{le="+Inf"} `,
+		"treblle_middleware_overhead_seconds_count ",
+		`treblle_circuit_state{state="closed"} 1`,
+		`treblle_circuit_state{state="open"} 0`,
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, DeliveryStats{
+		Captured:    3,
+		Dropped:     DroppedStats{QueueFull: 2},
+		SendLatency: Histogram{Buckets: []HistogramBucket{{UpperBound: 0.5, Count: 1}}, Count: 2, Sum: 1.25},
+		Circuit:     CircuitBreakerStats{State: CircuitHalfOpen},
+	})
+
+	body := buf.String()
+	assert.Contains(t, body, "treblle_requests_captured_total 3\n")
+	assert.Contains(t, body, `treblle_payloads_dropped_total{reason="queue_full"} 2`+"\n")
+	assert.Contains(t, body, `treblle_send_duration_seconds_bucket{le="0.5"} 1`+"\n")
+	assert.Contains(t, body, `treblle_send_duration_seconds_bucket{le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, "treblle_send_duration_seconds_sum 1.25\ntreblle_send_duration_seconds_count 2\n")
+	assert.Contains(t, body, `treblle_circuit_state{state="half_open"} 1`+"\n")
+}
+
+func TestExpvarPublication(t *testing.T) {
+	Configure(Configuration{ExpvarEnabled: true})
+	defer Configure(Configuration{})
+	// Configuring again does not publish twice
+	Configure(Configuration{ExpvarEnabled: true})
+
+	published := expvar.Get("treblle")
+	require.NotNil(t, published)
+
+	var stats DeliveryStats
+	require.NoError(t, json.Unmarshal([]byte(published.String()), &stats))
+	assert.Equal(t, CircuitClosed, stats.Circuit.State)
+}
@@ -1,17 +1,15 @@
 package treblle
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
-	"net/http"
 	"time"
 )
 
 const (
-	timeoutDuration = 2 * time.Second
+	timeoutDuration = 5 * time.Second
 )
 
 type BaseUrlOptions struct {
@@ -19,96 +17,104 @@ type BaseUrlOptions struct {
 }
 
 func getTreblleBaseUrl() string {
+	return getTreblleBaseUrls()[0]
+}
+
+// treblleBaseUrls are the Treblle ingestion endpoints
+var treblleBaseUrls = []string{
+	"https://rocknrolla.treblle.com",
+	"https://punisher.treblle.com",
+	"https://sicario.treblle.com",
+}
+
+// getTreblleBaseUrls returns the endpoints payloads are sent to, starting
+// with a random Treblle endpoint and failing over to the others in turn
+func getTreblleBaseUrls() []string {
 	// If custom endpoint is set, use it
 	if Config.Endpoint != "" {
-		return Config.Endpoint
-	}
-
-	// Default Treblle endpoints
-	treblleBaseUrls := []string{
-		"https://rocknrolla.treblle.com",
-		"https://punisher.treblle.com",
-		"https://sicario.treblle.com",
+		return []string{Config.Endpoint}
 	}
 
-	rand.Seed(time.Now().Unix())
 	randomUrlIndex := rand.Intn(len(treblleBaseUrls))
 
-	return treblleBaseUrls[randomUrlIndex]
+	urls := make([]string, 0, len(treblleBaseUrls))
+	urls = append(urls, treblleBaseUrls[randomUrlIndex:]...)
+	return append(urls, treblleBaseUrls[:randomUrlIndex]...)
 }
 
 func sendToTreblle(treblleInfo MetaData) {
-	// Use the context-aware version with a default timeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	// Use the context-aware version with the payload deadline
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout())
 	defer cancel()
 
 	sendToTreblleWithContext(ctx, treblleInfo)
 }
 
-// sendToTreblleWithContext sends data to Treblle with context support
-func sendToTreblleWithContext(ctx context.Context, treblleInfo MetaData) error {
-	baseUrl := getTreblleBaseUrl()
-
-	// Print debug info if debug mode is enabled
-	if Config.Debug {
-		fmt.Printf("\n==== DEBUG: TREBLLE ENDPOINT ====\n")
-		fmt.Printf("Sending to: %s\n", baseUrl)
-		fmt.Printf("================================\n")
+// flushSender sends the payloads a Flusher still holds
+func flushSender(sender Sender) {
+	flusher, ok := sender.(Flusher)
+	if !ok {
+		return
 	}
 
-	bytesRepresentation, err := json.Marshal(treblleInfo)
-	if err != nil {
-		return err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout())
+	defer cancel()
 
-	// Print debug info if debug mode is enabled
-	if Config.Debug {
-		prettyJson, _ := json.MarshalIndent(treblleInfo, "", "  ")
-		fmt.Println("\n==== DEBUG: TREBLLE PAYLOAD ====")
-		fmt.Println(string(prettyJson))
-		fmt.Println("=================================")
-
-		// Highlight the critical fields used for endpoint grouping
-		fmt.Println("\n🔍 Important fields for endpoint grouping:")
-		fmt.Printf("Request 'url' field: %s\n", treblleInfo.Data.Request.Url)
-		fmt.Printf("Request 'route_path' field: %s\n", treblleInfo.Data.Request.RoutePath)
-		//fmt.Printf("Request 'full_url' field: %s\n", treblleInfo.Data.Request.FullUrl)
-		fmt.Println("=================================")
+	if err := flusher.Flush(ctx); err != nil && Config.Debug {
+		fmt.Printf("Failed to flush payloads: %v\n", err)
 	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseUrl, bytes.NewBuffer(bytesRepresentation))
-	if err != nil {
-		return err
+// sendTimeout returns the total time allowed to deliver a payload
+func sendTimeout() time.Duration {
+	if Config.SendTimeout > 0 {
+		return Config.SendTimeout
 	}
-	// Set the content type from the writer, it includes necessary boundary as well
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", Config.APIKey)
+	return timeoutDuration
+}
 
-	client := &http.Client{
-		// No need for timeout here as we're using context timeout
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+// sendToTreblleWithContext sends data with the configured Sender
+func sendToTreblleWithContext(ctx context.Context, treblleInfo MetaData) error {
+	_, err := deliverPayload(ctx, treblleInfo)
+	return err
+}
+
+// deliverPayload sends data with the configured Sender, spooling it when
+// that fails and a spool is configured. It reports whether the payload was
+// spooled rather than delivered.
+func deliverPayload(ctx context.Context, treblleInfo MetaData) (bool, error) {
+	sender := Config.Sender
+	if sender == nil {
+		sender = &HTTPSender{}
 	}
-	defer resp.Body.Close()
 
-	if Config.Debug {
-		fmt.Printf("\n==== DEBUG: TREBLLE RESPONSE ====\n")
-		fmt.Printf("Status: %s\n", resp.Status)
-
-		// Read and log response body
-		respBody := make([]byte, 1024)
-		n, _ := resp.Body.Read(respBody)
-		if n > 0 {
-			fmt.Printf("Response: %s\n", respBody[:n])
+	// A batching sender guards, reports and spools its own deliveries
+	if _, batching := sender.(*BatchSender); batching {
+		err := sender.Send(ctx, treblleInfo)
+		if err != nil && Config.Debug {
+			fmt.Printf("Failed to send payload: %v\n", err)
 		}
-		fmt.Printf("================================\n")
+		return false, err
 	}
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("treblle api returned error status: %s", resp.Status)
+	// The payload is spooled with its key, so replaying it is not counted twice
+	key := payloadIdempotencyKey(ctx)
+	ctx = withIdempotencyKey(ctx, key)
+
+	start := time.Now()
+	err := Config.breaker.guard(func() error { return sender.Send(ctx, treblleInfo) })
+	telemetry.recordDelivery(1, start, err)
+	if err == nil {
+		Config.spool.delivered()
+		return false, nil
 	}
 
-	return nil
+	// Keep the payload for later when a spool is configured
+	if data, marshalErr := json.Marshal(treblleInfo); marshalErr == nil && spoolFailed(err, key, data) {
+		return true, nil
+	}
+	if Config.Debug {
+		fmt.Printf("Failed to send payload: %v\n", err)
+	}
+	return false, err
 }
@@ -0,0 +1,96 @@
+package treblle
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// getBodyPreview masks the part of a body that fits in the capture limit.
+// JSON documents keep their complete leading top-level keys or array
+// elements, NDJSON and form bodies their complete records. Bodies of other
+// codecs cannot be cut safely and are left out.
+func getBodyPreview(codec BodyCodec, body []byte) (json.RawMessage, bool) {
+	var data interface{}
+	switch codec.(type) {
+	case JSONCodec:
+		var ok bool
+		if data, ok = previewJSON(body); !ok {
+			return nil, false
+		}
+	case NDJSONCodec, FormCodec:
+		separator := byte('\n')
+		if _, isForm := codec.(FormCodec); isForm {
+			separator = '&'
+		}
+		// Drop the record cut off by the limit
+		if i := bytes.LastIndexByte(body, separator); i >= 0 {
+			body = body[:i]
+		} else {
+			body = nil
+		}
+		var err error
+		if data, err = codec.Decode(body); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	preview, err := codec.Encode(maskData(data))
+	if err != nil {
+		return nil, false
+	}
+	return preview, true
+}
+
+// previewJSON decodes the complete top-level members of a JSON object or
+// array that was cut short
+func previewJSON(body []byte) (interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, false
+	}
+
+	switch token {
+	case json.Delim('{'):
+		data := make(map[string]interface{})
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				break
+			}
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				break
+			}
+			data[key.(string)] = value
+		}
+		return data, true
+	case json.Delim('['):
+		data := make([]interface{}, 0)
+		for decoder.More() {
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				break
+			}
+			data = append(data, value)
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// trimPartialRune drops a UTF-8 sequence cut in half by the capture limit
+func trimPartialRune(body []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(body); i++ {
+		if utf8.RuneStart(body[len(body)-i]) {
+			if !utf8.FullRune(body[len(body)-i:]) {
+				return body[:len(body)-i]
+			}
+			break
+		}
+	}
+	return body
+}
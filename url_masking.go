@@ -0,0 +1,99 @@
+package treblle
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// PathMaskRule masks segments of the reported URL path. A rule selects the
+// segments every condition it sets matches: the parameter segments of Path
+// when the request path fits the template, and any segment the detector
+// recognises.
+type PathMaskRule struct {
+	Path     string       // Route template whose {param} or :param segments are masked, e.g. "/reset-password/{token}"
+	Detector MaskDetector // Detector a segment must match, e.g. DetectEmail
+	Strategy MaskStrategy // How selected segments are masked (default: full, MaskDrop masks fully too)
+}
+
+// getMaskedPath applies the path mask rules to an escaped URL path. The
+// first rule selecting a segment decides how it is masked.
+func getMaskedPath(escapedPath string) string {
+	if len(Config.PathMaskRules) == 0 {
+		return escapedPath
+	}
+
+	segments := strings.Split(escapedPath, "/")
+	masked := make([]bool, len(segments))
+	for _, rule := range Config.PathMaskRules {
+		candidates := pathMaskCandidates(rule.Path, segments)
+
+		var detector func(string) bool
+		if rule.Detector != "" {
+			var ok bool
+			if detector, ok = maskDetectors[rule.Detector]; !ok {
+				continue
+			}
+		}
+		if candidates == nil && detector == nil {
+			continue
+		}
+
+		strategy := rule.Strategy
+		if strategy == "" || strategy == MaskDrop {
+			strategy = MaskFull
+		}
+
+		for i, segment := range segments {
+			if masked[i] || segment == "" || (candidates != nil && !candidates[i]) {
+				continue
+			}
+			value, err := url.PathUnescape(segment)
+			if err != nil {
+				value = segment
+			}
+			if detector != nil && !detector(value) {
+				continue
+			}
+
+			maskedValue, _ := scalarText(Config.masking.apply(value, strategy))
+			// Keep the asterisks of masked values readable
+			segments[i] = strings.ReplaceAll(url.PathEscape(maskedValue), "%2A", "*")
+			masked[i] = true
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// pathMaskCandidates returns the parameter segments of template when the
+// path segments fit it. A rule without a template leaves every segment a
+// candidate, reported as a nil result.
+func pathMaskCandidates(template string, segments []string) map[int]bool {
+	if template == "" {
+		return nil
+	}
+
+	parts := strings.Split(template, "/")
+	if !strings.HasPrefix(template, "/") {
+		parts = append([]string{""}, parts...)
+	}
+	// A trailing slash does not change the route
+	if len(segments) == len(parts)+1 && segments[len(segments)-1] == "" {
+		parts = append(parts, "")
+	}
+	if len(parts) != len(segments) {
+		return map[int]bool{}
+	}
+
+	params := make(map[int]bool)
+	for i, part := range parts {
+		if (strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}")) || strings.HasPrefix(part, ":") {
+			params[i] = true
+			continue
+		}
+		if ok, err := path.Match(part, segments[i]); err != nil || !ok {
+			return map[int]bool{}
+		}
+	}
+	return params
+}
@@ -0,0 +1,64 @@
+package treblle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMaskedPath(t *testing.T) {
+	Configure(Configuration{
+		PathMaskRules: []PathMaskRule{
+			{Path: "/reset-password/{token}"},
+			{Path: "/v*/invites/:code", Strategy: MaskLast4},
+			{Detector: DetectEmail},
+		},
+	})
+	defer Configure(Configuration{})
+
+	testCases := map[string]string{
+		"/reset-password/abc123":            "/reset-password/*********",
+		"/reset-password/abc123/":           "/reset-password/*********/",
+		"/reset-password":                   "/reset-password",
+		"/reset-password/abc123/confirm":    "/reset-password/abc123/confirm",
+		"/v2/invites/XYZ98765":              "/v2/invites/****8765",
+		"/users/john@acme.com":              "/users/*********",
+		"/users/john%40acme.com/orders":     "/users/*********/orders",
+		"/users/42":                         "/users/42",
+		"/reset-password/john@acme.com/two": "/reset-password/*********/two",
+	}
+
+	for path, expected := range testCases {
+		assert.Equal(t, expected, getMaskedPath(path), path)
+	}
+}
+
+func TestRequestURLMasked(t *testing.T) {
+	Configure(Configuration{
+		DefaultFieldsToMask: []string{"token", "email"},
+		PathMaskRules:       []PathMaskRule{{Detector: DetectEmail, Strategy: MaskHash}},
+		MaskHashSalt:        "salt",
+	})
+	defer Configure(Configuration{})
+
+	r := httptest.NewRequest(http.MethodGet, "https://api.example.com/users/john@acme.com?token=abc&page=2", nil)
+	requestInfo, err := getRequestInfo(r, time.Now(), NewErrorProvider())
+	require.NoError(t, err)
+
+	hashed := Config.masking.apply("john@acme.com", MaskHash).(string)
+	assert.Equal(t, "https://api.example.com/users/"+hashed+"?page=2&token=%2A%2A%2A%2A%2A%2A%2A%2A%2A", requestInfo.Url)
+	assert.Equal(t, "/users/"+hashed, requestInfo.RoutePath)
+	assert.NotContains(t, requestInfo.Url, "abc")
+	assert.JSONEq(t, `{"query":"page=2&token=%2A%2A%2A%2A%2A%2A%2A%2A%2A"}`, string(requestInfo.Query))
+
+	// Without a query string the URL has no trailing question mark
+	r = httptest.NewRequest(http.MethodGet, "http://api.example.com/health", nil)
+	requestInfo, err = getRequestInfo(r, time.Now(), NewErrorProvider())
+	require.NoError(t, err)
+	assert.Equal(t, "http://api.example.com/health", requestInfo.Url)
+	assert.JSONEq(t, `{}`, string(requestInfo.Query))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -16,20 +17,35 @@ func getMaskedQueryString(query url.Values) string {
 	// Create a copy of the query values to avoid modifying the original
 	maskedQuery := make(url.Values)
 	for key, values := range query {
-		if shouldMaskField(key) {
-			maskedValues := make([]string, len(values))
-			for i := range values {
-				maskedValues[i] = maskValue(values[i], key).(string)
+		maskedValues := make([]string, 0, len(values))
+		for _, value := range values {
+			if masked, ok := maskNamedValue(key, value); ok {
+				maskedValues = append(maskedValues, fmt.Sprint(masked))
 			}
+		}
+		if len(maskedValues) > 0 {
 			maskedQuery[key] = maskedValues
-		} else {
-			maskedQuery[key] = values
 		}
 	}
 
 	return maskedQuery.Encode()
 }
 
+// maskNamedValue masks a query parameter or header value. It returns false
+// when a mask rule drops the value.
+func maskNamedValue(name, value string) (interface{}, bool) {
+	if strategy, ok := Config.masking.match([]string{name}, name, value); ok {
+		if strategy == MaskDrop {
+			return nil, false
+		}
+		return Config.masking.apply(value, strategy), true
+	}
+	if shouldMaskField(name) {
+		return maskValue(value, name), true
+	}
+	return value, true
+}
+
 // getMaskedJSON masks sensitive fields in JSON data
 func getMaskedJSON(data []byte) (json.RawMessage, error) {
 	var jsonData interface{}
@@ -49,8 +65,23 @@ func getMaskedJSON(data []byte) (json.RawMessage, error) {
 
 // maskMap masks sensitive fields in a map based on configuration
 func maskMap(data map[string]interface{}) map[string]interface{} {
+	return maskMapAt(data, nil)
+}
+
+// maskMapAt masks a map found at path, applying the mask rules before the
+// masked field names
+func maskMapAt(data map[string]interface{}, path []string) map[string]interface{} {
 	result := make(map[string]interface{})
 	for key, value := range data {
+		keyPath := append(path[:len(path):len(path)], key)
+
+		if strategy, ok := Config.masking.match(keyPath, key, value); ok {
+			if strategy != MaskDrop {
+				result[key] = Config.masking.apply(value, strategy)
+			}
+			continue
+		}
+
 		// Check if this key should be masked
 		if shouldMaskField(strings.ToLower(key)) {
 			switch v := value.(type) {
@@ -74,7 +105,7 @@ func maskMap(data map[string]interface{}) map[string]interface{} {
 				}
 			}
 		} else {
-			result[key] = maskData(value)
+			result[key] = maskDataAt(value, keyPath)
 		}
 	}
 	return result
@@ -127,11 +158,15 @@ func maskValue(value interface{}, key string) interface{} {
 
 // maskData recursively masks data in different formats
 func maskData(data interface{}) interface{} {
+	return maskDataAt(data, nil)
+}
+
+func maskDataAt(data interface{}, path []string) interface{} {
 	switch v := data.(type) {
 	case map[string]interface{}:
-		return maskMap(v)
+		return maskMapAt(v, path)
 	case []interface{}:
-		return maskArray(v)
+		return maskArrayAt(v, path)
 	default:
 		return v
 	}
@@ -139,30 +174,48 @@ func maskData(data interface{}) interface{} {
 
 // maskArray handles masking of JSON arrays
 func maskArray(data []interface{}) []interface{} {
-	result := make([]interface{}, len(data))
+	return maskArrayAt(data, nil)
+}
+
+// maskArrayAt masks an array found at path. Its elements are addressed by
+// their index.
+func maskArrayAt(data []interface{}, path []string) []interface{} {
+	result := make([]interface{}, 0, len(data))
 	for i, v := range data {
-		result[i] = maskData(v)
+		elemPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+		if strategy, ok := Config.masking.match(elemPath, "", v); ok {
+			if strategy != MaskDrop {
+				result = append(result, Config.masking.apply(v, strategy))
+			}
+			continue
+		}
+		result = append(result, maskDataAt(v, elemPath))
 	}
 	return result
 }
 
 // shouldMaskField checks if a field should be masked based on configuration
 func shouldMaskField(fieldName string) bool {
-	// Convert field name to lowercase for consistent matching
-	fieldName = strings.ToLower(fieldName)
-
-	// Check direct match
-	if _, exists := Config.FieldsMap[fieldName]; exists {
-		return true
-	}
+	_, exists := Config.FieldsMap[canonicalFieldName(fieldName)]
+	return exists
+}
 
-	// Check with common prefixes
-	prefixes := []string{"x-", "x_"}
-	for _, prefix := range prefixes {
-		if _, exists := Config.FieldsMap[prefix+fieldName]; exists {
-			return true
+// canonicalFieldName folds case, separators and an "x-" prefix out of a
+// field name, so "apiKey", "api_key", "API-Key" and "X-Api-Key" all match
+// a single configured name
+func canonicalFieldName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, prefix := range []string{"x-", "x_"} {
+		if len(name) > len(prefix) && strings.HasPrefix(name, prefix) {
+			name = name[len(prefix):]
+			break
 		}
 	}
-
-	return false
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '_', '.', ' ':
+			return -1
+		}
+		return r
+	}, name)
 }
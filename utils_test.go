@@ -0,0 +1,94 @@
+package treblle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalFieldName(t *testing.T) {
+	testCases := map[string]string{
+		"apiKey":      "apikey",
+		"api_key":     "apikey",
+		"API-Key":     "apikey",
+		"X-Api-Key":   "apikey",
+		"x_api_key":   "apikey",
+		"card.number": "cardnumber",
+		" password ":  "password",
+		"x-":          "x",
+		"xray":        "xray",
+	}
+
+	for name, expected := range testCases {
+		assert.Equal(t, expected, canonicalFieldName(name), name)
+	}
+}
+
+func TestDefaultFieldsToMaskMatchAllSpellings(t *testing.T) {
+	Configure(Configuration{})
+
+	spellings := func(field string) []string {
+		return []string{
+			field,
+			toSnakeCase(field),
+			toCamelCase(field),
+			"X-" + toKebabCase(field),
+		}
+	}
+
+	for _, field := range getDefaultFieldsToMask() {
+		for _, spelling := range spellings(field) {
+			assert.True(t, shouldMaskField(spelling), "%s as %s", field, spelling)
+		}
+	}
+
+	assert.False(t, shouldMaskField("username"))
+	assert.False(t, shouldMaskField("X-Request-Id"))
+}
+
+func toSnakeCase(s string) string {
+	var out []rune
+	for i, r := range s {
+		switch {
+		case r == '-':
+			out = append(out, '_')
+		case r >= 'A' && r <= 'Z':
+			if i > 0 {
+				out = append(out, '_')
+			}
+			out = append(out, r+'a'-'A')
+		default:
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+func toKebabCase(s string) string {
+	var out []rune
+	for _, r := range toSnakeCase(s) {
+		if r == '_' {
+			r = '-'
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+func toCamelCase(s string) string {
+	var out []rune
+	upper := false
+	for _, r := range toSnakeCase(s) {
+		switch {
+		case r == '_':
+			upper = true
+		case upper && r >= 'a' && r <= 'z':
+			out = append(out, r-'a'+'A')
+			upper = false
+		default:
+			out = append(out, r)
+			upper = false
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,300 @@
+package treblle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// WebSocketClosedByClient is reported when the client sent the first close frame
+	WebSocketClosedByClient = "client"
+	// WebSocketClosedByServer is reported when the server sent the first close frame
+	WebSocketClosedByServer = "server"
+
+	wsOpcodeClose = 0x8
+)
+
+// WebSocketSessionInfo summarises a WebSocket connection once it is closed
+type WebSocketSessionInfo struct {
+	Duration  float64 `json:"duration"` // Milliseconds the connection was open
+	FramesIn  int     `json:"frames_in"`
+	FramesOut int     `json:"frames_out"`
+	BytesIn   int64   `json:"bytes_in"`
+	BytesOut  int64   `json:"bytes_out"`
+	CloseCode int     `json:"close_code,omitempty"`
+	ClosedBy  string  `json:"closed_by,omitempty"`
+}
+
+// isWebSocketUpgrade reports whether r asks to upgrade the connection to a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn wraps a hijacked connection and counts the WebSocket frames that
+// flow through it. The session is reported once, when the connection closes.
+type wsConn struct {
+	net.Conn
+	reader io.Reader
+
+	mu        sync.Mutex
+	openedAt  time.Time
+	in        wsFrameParser
+	out       wsFrameParser
+	closeCode int
+	closedBy  string
+
+	closeOnce sync.Once
+	onClose   func(*WebSocketSessionInfo)
+}
+
+// newWSConn wraps conn. Bytes already buffered by the server are replayed
+// first, and the outbound handshake is skipped when the handler still has
+// to write it itself.
+func newWSConn(conn net.Conn, buffered []byte, handshakeSent bool, onClose func(*WebSocketSessionInfo)) *wsConn {
+	c := &wsConn{
+		Conn:     conn,
+		reader:   io.MultiReader(bytes.NewReader(buffered), conn),
+		openedAt: time.Now(),
+		onClose:  onClose,
+	}
+	c.out.skipHandshake = !handshakeSent
+	return c
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.in.feed(b[:n], func(code int) { c.recordClose(code, WebSocketClosedByClient) })
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.out.feed(b[:n], func(code int) { c.recordClose(code, WebSocketClosedByServer) })
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// Close closes the connection and reports the session
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c.session())
+		}
+	})
+	return err
+}
+
+// recordClose keeps the first close frame seen in either direction
+func (c *wsConn) recordClose(code int, by string) {
+	if c.closedBy == "" {
+		c.closeCode = code
+		c.closedBy = by
+	}
+}
+
+func (c *wsConn) session() *WebSocketSessionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &WebSocketSessionInfo{
+		Duration:  float64(time.Since(c.openedAt).Microseconds()) / 1000.0,
+		FramesIn:  c.in.frames,
+		FramesOut: c.out.frames,
+		BytesIn:   c.in.bytes,
+		BytesOut:  c.out.bytes,
+		CloseCode: c.closeCode,
+		ClosedBy:  c.closedBy,
+	}
+}
+
+// wsFrameParser follows the frame boundaries of one direction of a
+// WebSocket connection without buffering payloads
+type wsFrameParser struct {
+	frames int
+	bytes  int64
+
+	// skipHandshake drops bytes up to the end of the HTTP handshake
+	skipHandshake bool
+	handshakeTail []byte
+
+	header    [14]byte
+	headerLen int
+	inPayload bool
+	remaining uint64
+	position  uint64
+	opcode    byte
+	masked    bool
+	mask      [4]byte
+	closeBuf  [2]byte
+}
+
+// feed consumes b, calling onCloseFrame for every complete close frame
+func (p *wsFrameParser) feed(b []byte, onCloseFrame func(code int)) {
+	if p.skipHandshake {
+		b = p.skipHTTPHeader(b)
+	}
+	p.bytes += int64(len(b))
+
+	for len(b) > 0 {
+		if !p.inPayload {
+			b = p.readHeader(b)
+			if !p.inPayload {
+				continue
+			}
+			if p.remaining == 0 {
+				p.endFrame(onCloseFrame)
+			}
+			continue
+		}
+
+		n := uint64(len(b))
+		if n > p.remaining {
+			n = p.remaining
+		}
+		if p.opcode == wsOpcodeClose {
+			for i := uint64(0); i < n && p.position+i < 2; i++ {
+				v := b[i]
+				if p.masked {
+					v ^= p.mask[(p.position+i)%4]
+				}
+				p.closeBuf[p.position+i] = v
+			}
+		}
+		p.position += n
+		p.remaining -= n
+		b = b[n:]
+		if p.remaining == 0 {
+			p.endFrame(onCloseFrame)
+		}
+	}
+}
+
+// readHeader accumulates header bytes and returns whatever is left of b
+func (p *wsFrameParser) readHeader(b []byte) []byte {
+	for len(b) > 0 {
+		p.header[p.headerLen] = b[0]
+		p.headerLen++
+		b = b[1:]
+
+		need := 2
+		if p.headerLen >= 2 {
+			switch p.header[1] & 0x7f {
+			case 126:
+				need += 2
+			case 127:
+				need += 8
+			}
+			if p.header[1]&0x80 != 0 {
+				need += 4
+			}
+		}
+		if p.headerLen < need {
+			continue
+		}
+
+		p.opcode = p.header[0] & 0x0f
+		p.masked = p.header[1]&0x80 != 0
+		offset := 2
+		switch length := p.header[1] & 0x7f; length {
+		case 126:
+			p.remaining = uint64(binary.BigEndian.Uint16(p.header[2:4]))
+			offset = 4
+		case 127:
+			p.remaining = binary.BigEndian.Uint64(p.header[2:10])
+			offset = 10
+		default:
+			p.remaining = uint64(length)
+		}
+		if p.masked {
+			copy(p.mask[:], p.header[offset:offset+4])
+		}
+
+		p.frames++
+		p.headerLen = 0
+		p.position = 0
+		p.inPayload = true
+		return b
+	}
+	return b
+}
+
+func (p *wsFrameParser) endFrame(onCloseFrame func(code int)) {
+	if p.opcode == wsOpcodeClose {
+		code := 0
+		if p.position >= 2 {
+			code = int(binary.BigEndian.Uint16(p.closeBuf[:]))
+		}
+		onCloseFrame(code)
+	}
+	p.inPayload = false
+}
+
+// skipHTTPHeader drops bytes up to and including the blank line that ends
+// the handshake response
+func (p *wsFrameParser) skipHTTPHeader(b []byte) []byte {
+	data := append(p.handshakeTail, b...)
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		// Keep enough to detect a terminator split across writes
+		if len(data) > 3 {
+			data = data[len(data)-3:]
+		}
+		p.handshakeTail = append([]byte(nil), data...)
+		return nil
+	}
+	p.skipHandshake = false
+	p.handshakeTail = nil
+	// Only bytes of b past the terminator belong to frames
+	consumed := i + 4 - (len(data) - len(b))
+	return b[consumed:]
+}
+
+// getWebSocketResponseInfo reports the handshake response together with the
+// summary of the closed session
+func getWebSocketResponseInfo(response *responseWriter, session *WebSocketSessionInfo, startTime time.Time, errorProvider *ErrorProvider) ResponseInfo {
+	responseInfo := getResponseInfo(response, startTime, errorProvider)
+	responseInfo.Code = http.StatusSwitchingProtocols
+	responseInfo.Size = int(session.BytesOut)
+	responseInfo.Body = json.RawMessage("{}")
+	responseInfo.WebSocket = session
+	return responseInfo
+}
+
+// hijackWebSocket wraps a freshly hijacked connection so its frames are
+// counted, returning a matching bufio.ReadWriter
+func hijackWebSocket(conn net.Conn, brw *bufio.ReadWriter, handshakeSent bool, onClose func(*WebSocketSessionInfo)) (net.Conn, *bufio.ReadWriter) {
+	var buffered []byte
+	if brw != nil && brw.Reader.Buffered() > 0 {
+		buffered, _ = brw.Reader.Peek(brw.Reader.Buffered())
+		buffered = append([]byte(nil), buffered...)
+	}
+
+	ws := newWSConn(conn, buffered, handshakeSent, onClose)
+	return ws, bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws))
+}
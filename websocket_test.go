@@ -0,0 +1,176 @@
+package treblle
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wsFrame builds a single WebSocket frame, masked when mask is non-nil
+func wsFrame(opcode byte, payload []byte, mask []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func wsCloseFrame(code uint16, mask []byte) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	return wsFrame(wsOpcodeClose, payload, mask)
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	assert.False(t, isWebSocketUpgrade(r))
+
+	r.Header.Set("Upgrade", "WebSocket")
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	assert.True(t, isWebSocketUpgrade(r))
+
+	r.Header.Set("Connection", "keep-alive")
+	assert.False(t, isWebSocketUpgrade(r))
+}
+
+func TestWSFrameParser(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	stream := append(wsFrame(0x1, []byte("hello"), mask), wsFrame(0x2, make([]byte, 300), mask)...)
+	stream = append(stream, wsCloseFrame(1001, mask)...)
+
+	var parser wsFrameParser
+	var codes []int
+	// Feed one byte at a time to exercise every split point
+	for i := range stream {
+		parser.feed(stream[i:i+1], func(code int) { codes = append(codes, code) })
+	}
+
+	assert.Equal(t, 3, parser.frames)
+	assert.Equal(t, int64(len(stream)), parser.bytes)
+	assert.Equal(t, []int{1001}, codes)
+}
+
+func TestWSFrameParserSkipsHandshake(t *testing.T) {
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"
+	frame := wsFrame(0x1, []byte("hi"), nil)
+
+	parser := wsFrameParser{skipHandshake: true}
+	parser.feed([]byte(handshake[:20]), func(int) {})
+	parser.feed(append([]byte(handshake[20:]), frame...), func(int) {})
+
+	assert.Equal(t, 1, parser.frames)
+	assert.Equal(t, int64(len(frame)), parser.bytes)
+}
+
+func TestMiddlewareReportsWebSocketSession(t *testing.T) {
+	received := make(chan MetaData, 1)
+	treblleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta MetaData
+		if err := json.NewDecoder(r.Body).Decode(&meta); err == nil {
+			received <- meta
+		}
+	}))
+	defer treblleServer.Close()
+
+	Configure(Configuration{
+		SDK_TOKEN: "test-sdk-token",
+		API_KEY:   "test-api-key",
+		Endpoint:  treblleServer.URL,
+	})
+
+	// An echo server that reads one message and answers the close handshake
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+
+		header := make([]byte, 6)
+		_, err = io.ReadFull(brw, header)
+		require.NoError(t, err)
+		payload := make([]byte, header[1]&0x7f)
+		_, err = io.ReadFull(brw, payload)
+		require.NoError(t, err)
+		for i := range payload {
+			payload[i] ^= header[2+i%4]
+		}
+		brw.Write(wsFrame(0x1, payload, nil))
+		brw.Flush()
+
+		closeFrame := make([]byte, 8)
+		_, err = io.ReadFull(brw, closeFrame)
+		require.NoError(t, err)
+		brw.Write(wsCloseFrame(1000, nil))
+		brw.Flush()
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	mask := []byte{9, 8, 7, 6}
+	conn.Write(wsFrame(0x1, []byte("ping"), mask))
+	echo := make([]byte, 6)
+	_, err = io.ReadFull(reader, echo)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echo[2:]))
+
+	conn.Write(wsCloseFrame(1000, mask))
+
+	select {
+	case meta := <-received:
+		assert.Equal(t, http.StatusSwitchingProtocols, meta.Data.Response.Code)
+		assert.Equal(t, "/ws", meta.Data.Request.RoutePath)
+		ws := meta.Data.Response.WebSocket
+		require.NotNil(t, ws)
+		assert.Equal(t, 2, ws.FramesIn)
+		assert.Equal(t, 2, ws.FramesOut)
+		assert.Equal(t, int64(18), ws.BytesIn)
+		assert.Equal(t, int64(10), ws.BytesOut)
+		assert.Equal(t, 1000, ws.CloseCode)
+		assert.Equal(t, WebSocketClosedByClient, ws.ClosedBy)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Treblle payload")
+	}
+}